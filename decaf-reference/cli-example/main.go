@@ -1,7 +1,9 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -10,25 +12,67 @@ import (
 	decaf_reference "github.com/weebney/decaf/decaf-reference"
 )
 
+var (
+	listFlag    = flag.Bool("list", false, "list an archive's entries instead of extracting them")
+	includeFlag = flag.String("include", "", "comma-separated double-star glob patterns; only matching entries are archived/extracted")
+	excludeFlag = flag.String("exclude", "", "comma-separated double-star glob patterns; matching entries are skipped")
+)
+
 func usage() {
 	executable := os.Args[0]
-	fmt.Printf("USAGE: %s {DIRECTORY PATH | ARCHIVE PATH}\n", executable)
+	fmt.Printf("USAGE: %s [-list] [-include PATTERNS] [-exclude PATTERNS] {DIRECTORY PATH | ARCHIVE PATH}\n", executable)
+	fmt.Printf("       %s extract ARCHIVE_PATH OUTPUT_DIR ENTRY [ENTRY...]\n", executable)
 	fmt.Printf("If a directory is passed, it is archived to `./DIRECTORY_NAME.df`\n")
 	fmt.Printf("If an archive is passed, it is extracted to `./ARCHIVE_NAME/`\n")
+	fmt.Printf("If -list is passed with an archive, its entries are printed instead of being extracted\n")
+	fmt.Printf("`extract` only reads the bundles containing the named entries, not the whole archive\n")
+	fmt.Printf("-include and -exclude take comma-separated double-star glob patterns, e.g. -include '**/*.go,**/*.md'\n")
 	fmt.Printf("`%s ./samples.df` will create a directory `./samples/`\n", executable)
 	fmt.Printf("`%s /home/jeff/photos/` will create an archive file `./photos.df`\n", executable)
 }
 
+func splitPatterns(patterns string) []string {
+	if patterns == "" {
+		return nil
+	}
+	return strings.Split(patterns, ",")
+}
+
 func main() {
-	args := os.Args
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+
+	if len(args) >= 1 && args[0] == "extract" {
+		if len(args) < 4 {
+			usage()
+			os.Exit(1)
+		}
+		if err := ExtractEntries(args[1], args[2], args[3:]); err != nil {
+			fmt.Printf("Failed to extract entries from `%s`: %s\n", args[1], err)
+			os.Exit(6)
+		}
+		return
+	}
 
 	// not enough args or too many args
-	if len(args) < 2 || len(args) > 2 {
+	if len(args) != 1 {
 		usage()
 		os.Exit(1)
 	}
 
-	inputPath := args[1]
+	inputPath := args[0]
+	include := splitPatterns(*includeFlag)
+	exclude := splitPatterns(*excludeFlag)
+
+	if *listFlag {
+		if err := ListArchiveEntries(inputPath); err != nil {
+			fmt.Printf("Failed to list entries of `%s`: %s\n", inputPath, err)
+			os.Exit(3)
+		}
+		return
+	}
+
 	stat, err := os.Stat(inputPath)
 	if err != nil {
 		fmt.Printf("Failed to stat path `%s`: %s\n", inputPath, err)
@@ -41,7 +85,7 @@ func main() {
 		// if the input path is a dir, we're making an archive
 		outputArchivePath := filepath.Base(inputPath) + ".df"
 		fmt.Printf("Creating an archive from directory `%s` to `%s`\n", inputPath, outputArchivePath)
-		err = ArchiveDirectoryToFile(inputPath, outputArchivePath)
+		err = ArchiveDirectoryToFile(inputPath, outputArchivePath, include, exclude)
 		if err != nil {
 			fmt.Printf("Failed to archive from path `%s`: %s\n", inputPath, err)
 			os.Exit(4)
@@ -51,7 +95,7 @@ func main() {
 		// if not, we're unarchiving the directory at the path
 		outputDirPath := strings.TrimSuffix(filepath.Base(inputPath), ".df")
 		fmt.Printf("Creating a directory from archive `%s` to `%s`\n", inputPath, outputDirPath)
-		err = UnarchiveFileToDirectory(inputPath, outputDirPath)
+		err = UnarchiveFileToDirectory(inputPath, outputDirPath, include, exclude)
 		if err != nil {
 			fmt.Printf("Failed to unarchive from path `%s`: %s\n", inputPath, err)
 			os.Exit(5)
@@ -62,30 +106,145 @@ func main() {
 	// implicitly exits with 0
 }
 
-func ArchiveDirectoryToFile(directoryPath string, outputFilePath string) error {
-	archive, err := decaf_reference.Archive(directoryPath)
+// ArchiveDirectoryToFile writes the archive to outputFilePath through a
+// decaf_reference.Writer instead of first building it as one []byte. Peak
+// memory is not bounded: the Writer holds every entry's content until Close.
+// include/exclude, if non-empty, restrict which entries get archived.
+func ArchiveDirectoryToFile(directoryPath string, outputFilePath string, include, exclude []string) error {
+	outFile, err := os.Create(outputFilePath)
 	if err != nil {
-		return fmt.Errorf("failed to archive directory `%s`: %s", directoryPath, err)
+		return fmt.Errorf("failed to create output file `%s`: %w", outputFilePath, err)
 	}
+	defer outFile.Close()
 
-	outFile, err := os.Create(outputFilePath)
-	_, err = outFile.Write(archive)
+	aw, err := decaf_reference.NewWriter(outFile, &decaf_reference.Options{Include: include, Exclude: exclude})
+	if err != nil {
+		return fmt.Errorf("failed to create archive writer for `%s`: %w", outputFilePath, err)
+	}
+	if err := aw.WriteDirectory(directoryPath); err != nil {
+		return fmt.Errorf("failed to archive directory `%s`: %w", directoryPath, err)
+	}
+	if err := aw.Close(); err != nil {
+		return fmt.Errorf("failed to finish archive `%s`: %w", outputFilePath, err)
+	}
+
+	return nil
+}
+
+// UnarchiveFileToDirectory streams archivePath's content directly onto disk
+// rather than reading the whole archive into memory first, so peak memory
+// stays bounded regardless of how large the archive is. include/exclude, if
+// non-empty, restrict which entries get extracted; because restricting
+// requires skipping individual entries rather than just draining the whole
+// Reader, this reads the archive into memory and uses UnarchiveWithOptions
+// instead of streaming through a Reader directly.
+func UnarchiveFileToDirectory(archivePath string, outputDirectoryPath string, include, exclude []string) error {
+	if len(include) == 0 && len(exclude) == 0 {
+		archiveFile, err := os.Open(archivePath)
+		if err != nil {
+			return fmt.Errorf("failed to open archive file `%s`: %w", archivePath, err)
+		}
+		defer archiveFile.Close()
+
+		ar, err := decaf_reference.NewReader(archiveFile)
+		if err != nil {
+			return fmt.Errorf("failed to read archive `%s`: %w", archivePath, err)
+		}
+
+		if err := decaf_reference.ExtractTo(ar, outputDirectoryPath); err != nil {
+			return fmt.Errorf("failed to unarchive to `%s`: %w", outputDirectoryPath, err)
+		}
+
+		return nil
+	}
+
+	archive, err := os.ReadFile(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to read archive file `%s`: %w", archivePath, err)
+	}
+
+	opts := decaf_reference.UnarchiveOptions{Include: include, Exclude: exclude}
+	if err := decaf_reference.UnarchiveWithOptions(archive, outputDirectoryPath, opts); err != nil {
+		return fmt.Errorf("failed to unarchive to `%s`: %w", outputDirectoryPath, err)
+	}
+
+	return nil
+}
+
+// ListArchiveEntries prints every entry in the archive at archivePath
+// without extracting anything.
+func ListArchiveEntries(archivePath string) error {
+	archive, err := os.ReadFile(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to read archive file `%s`: %w", archivePath, err)
+	}
+
+	entries, err := decaf_reference.ListEntries(archive)
 	if err != nil {
-		return fmt.Errorf("failed to create output file `%s`: %s", outputFilePath, err)
+		return fmt.Errorf("failed to list entries: %w", err)
+	}
+
+	for _, entry := range entries {
+		fmt.Printf("%12d  %s\n", entry.Size, entry.Path)
 	}
 
 	return nil
 }
 
-func UnarchiveFileToDirectory(archivePath string, outputDirectoryPath string) error {
-	archiveBytes, err := os.ReadFile(archivePath)
+// ExtractEntries extracts only the named entries from archivePath into
+// outputDirectoryPath, via decaf_reference.Open. Only the bundles
+// containing those entries are read and decompressed, so this stays fast
+// even for a huge archive when only a handful of entries are wanted.
+func ExtractEntries(archivePath string, outputDirectoryPath string, entryPaths []string) error {
+	archiveFile, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to open archive file `%s`: %w", archivePath, err)
+	}
+	defer archiveFile.Close()
+
+	stat, err := archiveFile.Stat()
 	if err != nil {
-		return fmt.Errorf("failed to read archive file `%s`: %s", archivePath, err)
+		return fmt.Errorf("failed to stat archive file `%s`: %w", archivePath, err)
 	}
 
-	err = decaf_reference.Unarchive(archiveBytes, outputDirectoryPath)
+	index, err := decaf_reference.Open(archiveFile, stat.Size())
 	if err != nil {
-		return fmt.Errorf("failed to unarchive to `%s`: %s", outputDirectoryPath, err)
+		return fmt.Errorf("failed to open archive `%s`: %w", archivePath, err)
+	}
+
+	for _, entryPath := range entryPaths {
+		entry, err := index.Entry(entryPath)
+		if err != nil {
+			return err
+		}
+
+		if !decaf_reference.IsPathSafe(entry.Path) {
+			return fmt.Errorf("entry `%s`: %w", entryPath, decaf_reference.ErrPathEscape)
+		}
+
+		content, err := entry.Open()
+		if err != nil {
+			return fmt.Errorf("failed to open entry `%s`: %w", entryPath, err)
+		}
+
+		outputPath := filepath.Join(outputDirectoryPath, entry.Path)
+		if err := os.MkdirAll(filepath.Dir(outputPath), 0o100755); err != nil {
+			content.Close()
+			return fmt.Errorf("failed to create directory for `%s`: %w", outputPath, err)
+		}
+
+		outFile, err := os.Create(outputPath)
+		if err != nil {
+			content.Close()
+			return fmt.Errorf("failed to create `%s`: %w", outputPath, err)
+		}
+		if _, err := io.Copy(outFile, content); err != nil {
+			outFile.Close()
+			content.Close()
+			return fmt.Errorf("failed to write `%s`: %w", outputPath, err)
+		}
+		outFile.Close()
+		content.Close()
 	}
 
 	return nil
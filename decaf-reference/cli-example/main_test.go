@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	decaf_reference "github.com/weebney/decaf/decaf-reference"
+)
+
+func TestExtractEntriesRejectsPathEscape(t *testing.T) {
+	srcFS := fstest.MapFS{
+		"hello.txt": {Data: []byte("hello world"), Mode: 0o644},
+	}
+	archive, err := decaf_reference.ArchiveFS(srcFS, ".", nil)
+	if err != nil {
+		t.Fatalf("archiving failed: %s", err)
+	}
+
+	const escapingPath = "../../../../tmp/decaf-poc/PWNED.txt"
+	var buf bytes.Buffer
+	opts := decaf_reference.RepackOptions{Filter: func(path string) (string, bool) {
+		return escapingPath, true
+	}}
+	if err := decaf_reference.Repack(bytes.NewReader(archive), int64(len(archive)), &buf, opts); err != nil {
+		t.Fatalf("repacking failed: %s", err)
+	}
+
+	tempDir, err := os.MkdirTemp("", "decaf-cli-TestExtractEntriesRejectsPathEscape-*")
+	if err != nil {
+		t.Fatalf("setting up temporary directory failed: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	archivePath := filepath.Join(tempDir, "evil.df")
+	if err := os.WriteFile(archivePath, buf.Bytes(), 0o644); err != nil {
+		t.Fatalf("writing archive failed: %s", err)
+	}
+
+	outputDir := filepath.Join(tempDir, "out_extract")
+	err = ExtractEntries(archivePath, outputDir, []string{escapingPath})
+	if !errors.Is(err, decaf_reference.ErrPathEscape) {
+		t.Errorf("expected errors.Is(err, decaf_reference.ErrPathEscape), got %v", err)
+	}
+
+	if _, statErr := os.Stat(filepath.Join(outputDir, escapingPath)); !os.IsNotExist(statErr) {
+		t.Errorf("expected no file to be written outside outputDir, stat err = %v", statErr)
+	}
+}
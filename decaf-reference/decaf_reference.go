@@ -2,19 +2,85 @@
 package decaf_reference
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
+	pathpkg "path"
 	"path/filepath"
+	"runtime"
 	"slices"
 	"strings"
+	"sync"
 
-	"github.com/DataDog/zstd"
+	"github.com/bmatcuk/doublestar/v4"
 	"github.com/bytedance/gopkg/util/xxhash3"
 )
 
+// magicNumber identifies the first 8 bytes of every DeCAF archive, spelling "iamdecaf".
+const magicNumber uint64 = 0x66616365646D6169
+
+// currentFormatVersion is written into every archive's meta header. It
+// exists so that a per-bundle Codec other than the zstd every archive used
+// to hardwire can be introduced without quietly producing archives an older
+// build of this package would misread: NewReader and Open reject any
+// formatVersion they don't recognize with ErrUnsupportedVersion instead of
+// parsing a bundle header whose entries are a different size than they
+// expect, or decompressing a bundle with a codec they don't know.
+const currentFormatVersion uint64 = 1
+
+// bundleHeaderEntrySize is the serialized size, in bytes, of one Bundle in
+// the bundle header: 8 for offsetInDataSection, 8 for compressedSize, 8 for
+// uncompressedChecksum, and 1 for codec.
+const bundleHeaderEntrySize = 25
+
+var (
+	// ErrCorruptHeader indicates an archive's prefix, meta header, listing
+	// header, or bundle header doesn't parse: the archive is too small to
+	// contain one, or its magic number isn't "iamdecaf".
+	ErrCorruptHeader = errors.New("decaf: corrupt archive header")
+
+	// ErrChecksumMismatch indicates a bundle or listing's content didn't
+	// hash to the checksum recorded for it in the header, meaning the
+	// archive (or the compressed bytes read off of it) has been corrupted
+	// or tampered with since it was written.
+	ErrChecksumMismatch = errors.New("decaf: checksum mismatch")
+
+	// ErrUnsupportedVersion indicates an archive's meta header records a
+	// formatVersion other than currentFormatVersion, a bundle header entry
+	// records a codec ID codecByID doesn't know, or a listing's mode byte
+	// falls outside ModeNormal..ModeBareDir. Any of these most likely means
+	// the archive was written by a newer, incompatible version of DeCAF.
+	ErrUnsupportedVersion = errors.New("decaf: unsupported archive version")
+
+	// ErrPathEscape indicates an entry's path, joined with the extraction
+	// destination, would resolve outside of it (a "zip slip" style path),
+	// and so was rejected instead of being written.
+	ErrPathEscape = errors.New("decaf: entry path escapes destination directory")
+)
+
+// EntryError wraps an error encountered while archiving or extracting a
+// specific entry, recording which entry and what operation was underway
+// when it failed. Callers can errors.As to recover one and errors.Is against
+// its Err to tell, for example, a checksum mismatch apart from a plain
+// filesystem permission error.
+type EntryError struct {
+	Path string
+	Op   string
+	Err  error
+}
+
+func (e *EntryError) Error() string {
+	return fmt.Sprintf("decaf: %s `%s`: %s", e.Op, e.Path, e.Err)
+}
+
+func (e *EntryError) Unwrap() error {
+	return e.Err
+}
+
 type Listing struct {
 	// The total length in bytes of this Listing when written to the listing header.
 	// This is easily calculated by adding the length of the path to 48; 48 being the
@@ -56,6 +122,10 @@ type Bundle struct {
 	compressedSize       uint64
 	uncompressedChecksum uint64
 
+	// codec is the ID of the Codec this bundle's data was compressed with;
+	// see codecByID.
+	codec uint8
+
 	// Everything above here is information written directly into the header;
 	// below, is the compressed data of the listings who store their content
 	// in this bundle.
@@ -69,26 +139,369 @@ const (
 	ModeBareDir                 // 3, empty directories
 )
 
-func Archive(inputDirectoryPath string) ([]byte, error) {
+// Options configures a Writer. A nil Options is equivalent to &Options{}, which
+// selects the same defaults Archive has always used.
+type Options struct {
+	// CompressionLevel is the zstd level bundles are compressed with. Zero
+	// selects the default of 3.
+	CompressionLevel int
+
+	// Include, if non-empty, restricts archiving to entries whose
+	// archive-relative path matches at least one of these double-star glob
+	// patterns (see github.com/bmatcuk/doublestar). A nil or empty Include
+	// matches everything.
+	Include []string
+
+	// Exclude drops entries whose archive-relative path matches any of
+	// these double-star glob patterns, applied after Include.
+	Exclude []string
+
+	// FollowSymlinks, if true, archives the resolved target of in-scope
+	// symlinks as a regular or executable entry instead of a ModeLink
+	// entry, the same as tar's --dereference.
+	FollowSymlinks bool
+
+	// Concurrency bounds how many files are read/hashed and how many
+	// bundles are compressed at once. Zero selects runtime.NumCPU(); one
+	// forces the original single-threaded behavior. Archiving the same
+	// source always produces byte-identical output regardless of
+	// Concurrency, since only the read/compress work is parallelized, never
+	// the deterministic sort and bundle-assignment pass that precedes it.
+	Concurrency int
+
+	// Codec, if non-nil, compresses every bundle instead of the default
+	// ZstdCodec at CompressionLevel. It's a shorthand for a CodecSelector
+	// that returns the same Codec regardless of which listings it's asked
+	// about. Codec and CodecSelector are mutually exclusive; if both are
+	// set, CodecSelector wins.
+	Codec Codec
+
+	// CodecSelector picks the Codec each bundle is compressed with, given
+	// the listings being packed into it. This lets a caller, say, choose
+	// NoneCodec for a bundle of already-compressed media and ZstdCodec for
+	// everything else, so bundles in the same archive can use different
+	// codecs. A nil CodecSelector (the default) compresses every bundle
+	// with ZstdCodec at CompressionLevel, the same as every archive
+	// produced before per-bundle codecs existed.
+	CodecSelector func(listings []*Listing) Codec
+}
+
+// resolveConcurrency turns an Options.Concurrency value (0 = auto) into an
+// actual worker count.
+func resolveConcurrency(concurrency int) int {
+	if concurrency == 0 {
+		return runtime.NumCPU()
+	}
+	return concurrency
+}
+
+// parallelMap applies fn to every item in items using up to workers
+// goroutines, returning results in the same order as items regardless of
+// which goroutine finishes first. workers <= 1 (or fewer than two items)
+// runs fn sequentially on the calling goroutine instead of spinning up any.
+func parallelMap[T, R any](items []T, workers int, fn func(T) (R, error)) ([]R, error) {
+	results := make([]R, len(items))
+
+	if workers <= 1 || len(items) <= 1 {
+		for i, item := range items {
+			result, err := fn(item)
+			if err != nil {
+				return nil, err
+			}
+			results[i] = result
+		}
+		return results, nil
+	}
+
+	jobs := make(chan int)
+	errs := make(chan error, len(items))
+	var wg sync.WaitGroup
+
+	for range min(workers, len(items)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				result, err := fn(items[i])
+				if err != nil {
+					errs <- err
+					continue
+				}
+				results[i] = result
+			}
+		}()
+	}
+
+	for i := range items {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	close(errs)
+
+	if err, failed := <-errs; failed {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// matchesFilter reports whether path should be kept, given include/exclude
+// double-star glob patterns matched against archive-relative paths. An empty
+// include matches everything; exclude is applied after include.
+func matchesFilter(path string, include, exclude []string) (bool, error) {
+	keep := len(include) == 0
+	for _, pattern := range include {
+		matched, err := doublestar.Match(pattern, path)
+		if err != nil {
+			return false, fmt.Errorf("bad include pattern `%s`: %w", pattern, err)
+		}
+		if matched {
+			keep = true
+			break
+		}
+	}
+	if !keep {
+		return false, nil
+	}
+
+	for _, pattern := range exclude {
+		matched, err := doublestar.Match(pattern, path)
+		if err != nil {
+			return false, fmt.Errorf("bad exclude pattern `%s`: %w", pattern, err)
+		}
+		if matched {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// IsPathSafe reports whether an entry's path, once cleaned, stays within the
+// extraction destination instead of escaping it via ".." segments or an
+// absolute path (a "zip slip" style path). Every extraction path checks this
+// before touching a WritableFS, since nothing about the archive format
+// itself stops a crafted listing from naming a path like "../../etc/passwd".
+// It's exported so callers writing entries out by hand, like cli-example's
+// single-entry `extract` subcommand, can apply the same guard.
+func IsPathSafe(path string) bool {
+	cleaned := pathpkg.Clean(path)
+	return cleaned != ".." && !strings.HasPrefix(cleaned, "../") && !pathpkg.IsAbs(cleaned)
+}
+
+// WritableFS is the write side of a pluggable filesystem backend: the
+// extraction target ExtractToFS and UnarchiveFS materialize an archive's
+// entries onto. It mirrors the handful of os package-level functions
+// ExtractTo has always called directly, so the default OSFS implementation
+// is a thin pass-through to os.
+type WritableFS interface {
+	MkdirAll(path string, perm fs.FileMode) error
+	Create(name string) (io.WriteCloser, error)
+	Symlink(oldname, newname string) error
+	Chmod(name string, mode fs.FileMode) error
+}
+
+// ReadLinkFS is implemented by fs.FS backends that can resolve a symlink's
+// target, which plain fs.FS has no way to express. WriteFS only archives
+// ModeLink entries from source filesystems that implement it; other fs.FS
+// backends simply contribute no symlinks to the archive, the same as if
+// they had none.
+type ReadLinkFS interface {
+	fs.FS
+	ReadLink(name string) (string, error)
+}
+
+// OSFS is the default ReadLinkFS and WritableFS implementation, rooted at a
+// directory on disk. Archive and Unarchive route through it, so their
+// os-backed behavior is unchanged; ArchiveFS and UnarchiveFS accept any
+// other implementation of the same interfaces, e.g. an embed.FS or an
+// in-memory tree for tests.
+type OSFS struct {
+	root string
+	fs.FS
+}
+
+// NewOSFS returns an OSFS rooted at root, suitable both as a source for
+// WriteFS/ArchiveFS and as a destination for ExtractToFS/UnarchiveFS.
+func NewOSFS(root string) *OSFS {
+	return &OSFS{root: root, FS: os.DirFS(root)}
+}
+
+func (o *OSFS) ReadLink(name string) (string, error) {
+	return os.Readlink(filepath.Join(o.root, filepath.FromSlash(name)))
+}
+
+func (o *OSFS) MkdirAll(path string, perm fs.FileMode) error {
+	return os.MkdirAll(filepath.Join(o.root, filepath.FromSlash(path)), perm)
+}
+
+func (o *OSFS) Create(name string) (io.WriteCloser, error) {
+	return os.Create(filepath.Join(o.root, filepath.FromSlash(name)))
+}
+
+func (o *OSFS) Symlink(oldname, newname string) error {
+	return os.Symlink(oldname, filepath.Join(o.root, filepath.FromSlash(newname)))
+}
+
+func (o *OSFS) Chmod(name string, mode fs.FileMode) error {
+	return os.Chmod(filepath.Join(o.root, filepath.FromSlash(name)), mode)
+}
+
+// Writer assembles a DeCAF archive and streams the finished bytes to an
+// underlying io.Writer, modeled on archive/tar.Writer. Entries are collected
+// by WriteDirectory and only packed into bundles and written out on Close,
+// because the archive's header section records every bundle's offset and
+// compressed size, which aren't known until every entry has been seen.
+//
+// This means a Writer's peak memory is still proportional to the size of the
+// directory being archived, same as the old Archive function; what it avoids
+// is the second full copy Archive used to make by concatenating the finished
+// header and data sections into one returned []byte.
+type Writer struct {
+	w              io.Writer
+	level          int
+	include        []string
+	exclude        []string
+	followSymlinks bool
+	concurrency    int
+	codecSelector  func(listings []*Listing) Codec
+	listings       []*Listing
+	closed         bool
+}
+
+// NewWriter returns a Writer that streams a DeCAF archive to w as WriteDirectory
+// and Close are called.
+func NewWriter(w io.Writer, opts *Options) (*Writer, error) {
+	level := 3
+	aw := &Writer{w: w, concurrency: resolveConcurrency(0)}
+	if opts != nil {
+		if opts.CompressionLevel != 0 {
+			level = opts.CompressionLevel
+		}
+		aw.include = opts.Include
+		aw.exclude = opts.Exclude
+		aw.followSymlinks = opts.FollowSymlinks
+		aw.concurrency = resolveConcurrency(opts.Concurrency)
+		if opts.Codec != nil {
+			codec := opts.Codec
+			aw.codecSelector = func([]*Listing) Codec { return codec }
+		}
+		if opts.CodecSelector != nil {
+			aw.codecSelector = opts.CodecSelector
+		}
+	}
+	aw.level = level
+	if aw.codecSelector == nil {
+		aw.codecSelector = func([]*Listing) Codec { return ZstdCodec{Level: level} }
+	}
+	return aw, nil
+}
+
+// WriteDirectory walks inputDirectoryPath on the real filesystem and queues
+// every entry it finds for writing. It's a thin wrapper over WriteFS backed
+// by an OSFS rooted at inputDirectoryPath. The entries aren't actually
+// written to the underlying io.Writer until Close.
+func (aw *Writer) WriteDirectory(inputDirectoryPath string) error {
 	// Implementation specific, but to allow relative paths to be
 	// passed into this function, we first need to make that path absolute
 	inputDirectoryPath, err := filepath.Abs(inputDirectoryPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to make absolute path for path `%s`: %s", inputDirectoryPath, err)
+		return fmt.Errorf("failed to make absolute path for path `%s`: %w", inputDirectoryPath, err)
+	}
+
+	return aw.WriteFS(NewOSFS(inputDirectoryPath), ".")
+}
+
+// pendingFSEntry captures everything WriteFS's walk learns about one entry
+// before its content has been read. readPath, if non-empty, names the path
+// in srcFS the parallel read phase below should fs.ReadFile; entries that
+// need no read (ModeBareDir, and a ModeLink that isn't being dereferenced)
+// have fileContent filled in directly instead.
+type pendingFSEntry struct {
+	path        string
+	mode        uint8
+	readPath    string
+	fileContent []byte
+}
+
+// WriteFS walks srcFS starting at root and queues every entry it finds for
+// writing, the same as WriteDirectory but against any fs.FS instead of the
+// real filesystem. If srcFS implements ReadLinkFS, its symlinks are archived
+// as ModeLink entries; otherwise they're skipped entirely, same as
+// WriteDirectory has always done for symlinks that escape the archive's
+// root. The entries aren't actually written to the underlying io.Writer
+// until Close.
+//
+// The walk itself stays single-threaded, since fs.WalkDir already visits
+// directories in a deterministic, serial order and bare-directory detection
+// depends on that; only the file reads it turns up are parallelized, across
+// up to aw.concurrency goroutines, because for most trees reading and
+// hashing file content is what actually dominates archiving time.
+func (aw *Writer) WriteFS(srcFS fs.FS, root string) error {
+	pending, err := walkFSEntries(srcFS, root, aw.followSymlinks, aw.include, aw.exclude)
+	if err != nil {
+		return err
+	}
+
+	contents, err := readPendingContents(srcFS, pending, aw.concurrency)
+	if err != nil {
+		return err
+	}
+
+	// Partially construct a listing for each entry based on the information
+	// we've gathered. These are only partially constructed because they are
+	// missing the bundle information, which is generated in the next step.
+	for i, p := range pending {
+		fileContent := contents[i]
+		contentChecksum := uint64(0)
+		if p.mode == ModeNormal || p.mode == ModeExecutable {
+			contentChecksum = xxhash3.Hash(fileContent)
+		}
+
+		listing := Listing{
+			totalLength: uint16(len(p.path)) + 35, // 35 is the size of the written listing with no path
+			path:        p.path,
+			contentSize: uint64(len(fileContent)),
+			checksum:    contentChecksum,
+			mode:        p.mode,
+
+			fileContent: fileContent,
+		}
+
+		// Push a pointer to the partially constructed listing into the `listings` slice
+		aw.listings = append(aw.listings, &listing)
 	}
 
-	// First, we have to gather the required information from the filesystem to construct listings
-	listings := []*Listing{}
-	err = filepath.WalkDir(inputDirectoryPath, func(path string, dirEntry fs.DirEntry, err error) error {
+	return nil
+}
+
+// walkFSEntries walks srcFS starting at root and collects every in-scope
+// entry's path, mode, and the information needed to later read its content,
+// without reading any content itself. It's shared by Writer.WriteFS and
+// ChunkedWriter.WriteFS, which only differ in how they turn a read entry's
+// bytes into a listing.
+func walkFSEntries(srcFS fs.FS, root string, followSymlinks bool, include, exclude []string) ([]*pendingFSEntry, error) {
+	linkFS, supportsLinks := srcFS.(ReadLinkFS)
+
+	pending := []*pendingFSEntry{}
+
+	err := fs.WalkDir(srcFS, root, func(entryPath string, dirEntry fs.DirEntry, err error) error {
 		// This just allows us to pass the errors up the call stack
 		if err != nil {
 			return err
 		}
 
+		// root is the apex of the archive; it's implicit and never gets its
+		// own listing
+		if entryPath == root {
+			return nil
+		}
+
 		// We'll start by getting the fileInfo of the file
 		fileInfo, err := dirEntry.Info()
 		if err != nil {
-			return fmt.Errorf("failed to get info for dirEntry `%s`: %s", dirEntry.Name(), err)
+			return fmt.Errorf("failed to get info for dirEntry `%s`: %w", dirEntry.Name(), err)
 		}
 
 		// Now we can collect the necessary metadata to construct listings
@@ -97,9 +510,9 @@ func Archive(inputDirectoryPath string) ([]byte, error) {
 		case fileInfo.IsDir():
 			// We only care about directories that have no children (i.e. empty/bare directories);
 			// all other directories exist implicitly as far as DeCAF is concerned.
-			subEntries, err := os.ReadDir(path+"/fasfasfasf")
+			subEntries, err := fs.ReadDir(srcFS, entryPath)
 			if err != nil {
-				return fmt.Errorf("failed to read directory `%s`: %s", path, err)
+				return fmt.Errorf("failed to read directory `%s`: %w", entryPath, err)
 			}
 			// If this directory has children, skip it
 			if len(subEntries) > 1 {
@@ -118,77 +531,123 @@ func Archive(inputDirectoryPath string) ([]byte, error) {
 		}
 
 		// Links and bare directories maintain an empty content and checksum of 0
+		readPath := ""
 		fileContent := []byte{}
-		contentChecksum := uint64(0)
 		if listingMode == ModeNormal || listingMode == ModeExecutable {
-			// Get the content of the file off the disk for normal and executable files
-			fileContent, err = os.ReadFile(path)
-			if err != nil {
-				return fmt.Errorf("failed to read file `%s` with mode %d: %s", path, listingMode, err)
-			}
-			contentChecksum = xxhash3.Hash(fileContent)
+			// Defer the actual read to the parallel phase below; for normal
+			// and executable files, readPath is just entryPath itself.
+			readPath = entryPath
 		} else if listingMode == ModeLink {
+			// srcFS can't tell us where this symlink points, so we drop it
+			// rather than archive a broken entry.
+			if !supportsLinks {
+				return nil
+			}
+
 			// Handle symlinks, setting their fileContent to the path of the listing we want
-			readLink, err := os.Readlink(path)
+			readLink, err := linkFS.ReadLink(entryPath)
 			if err != nil {
-				return fmt.Errorf("failed to readlink for `%s`: %s", path, err)
+				return fmt.Errorf("failed to readlink for `%s`: %w", entryPath, err)
 			}
 
-			// normalize the link target
-			readLink = filepath.Clean(readLink)
+			// normalize the link target relative to the archive's root
+			readLink = pathpkg.Clean(pathpkg.Join(pathpkg.Dir(entryPath), readLink))
 
 			// We ignore symlinks that point outside the scope of the archive
-			readLink = filepath.Join(inputDirectoryPath, readLink)
-			if !strings.HasPrefix(readLink, inputDirectoryPath) {
+			if readLink == ".." || strings.HasPrefix(readLink, "../") {
 				return nil
 			}
 
 			// We ignore symlinks that point to other symlinks or files that dont exist
-			readLinkInfo, err := os.Lstat(readLink)
-			if errors.Is(err, os.ErrNotExist) {
+			targetInfo, err := fs.Stat(srcFS, readLink)
+			if errors.Is(err, fs.ErrNotExist) {
 				return nil
 			} else if err != nil {
-				return fmt.Errorf("failed to Lstat for `%s` from `%s`: %s", readLink, path, err)
+				return fmt.Errorf("failed to stat for `%s` from `%s`: %w", readLink, entryPath, err)
+			}
+			if targetInfo.Mode()&fs.ModeSymlink != 0 {
+				return nil
 			}
-			if readLinkInfo.Mode()&fs.ModeSymlink != 0 {
+			// fs.Stat follows symlinks on backends like os.DirFS, so also ask
+			// linkFS directly whether the target is itself a symlink.
+			if _, err := linkFS.ReadLink(readLink); err == nil {
 				return nil
 			}
 
-			// Finally, we can write the readlink into the fileContent
-			relativeReadlink, err := filepath.Rel(inputDirectoryPath, readLink)
-			if err != nil {
-				return fmt.Errorf("failed to get relative path for readlink `%s` for path `%s`: %s", readLink, path, err)
+			if followSymlinks {
+				// Dereference the link and archive the target's content
+				// directly, same as tar's --dereference.
+				listingMode = ModeNormal
+				if targetInfo.Mode()&1<<6 != 0 {
+					listingMode = ModeExecutable
+				}
+				readPath = readLink
+			} else {
+				// Finally, we can write the readlink into the fileContent
+				fileContent = []byte(readLink)
 			}
-			fileContent = []byte(relativeReadlink)
 		}
 
-		// We get the final relative path that will be written into the listing
-		relativePath, err := filepath.Rel(inputDirectoryPath, path)
+		keep, err := matchesFilter(entryPath, include, exclude)
 		if err != nil {
-			return fmt.Errorf("failed to get relative path for path `%s`: %s", path, err)
+			return err
+		}
+		if !keep {
+			return nil
 		}
 
-		// Partially construct a listing based on the information we've gathered
-		// These are only partially constructed because they are missing the bundle
-		// information, which is generated in the next step.
-		listing := Listing{
-			totalLength: uint16(len(relativePath)) + 35, // 38 is the size of the written listing with no path
-			path:        relativePath,
-			contentSize: uint64(len(fileContent)),
-			checksum:    contentChecksum,
+		pending = append(pending, &pendingFSEntry{
+			path:        entryPath,
 			mode:        listingMode,
-
+			readPath:    readPath,
 			fileContent: fileContent,
-		}
-
-		// Push a pointer to the partially constructed listing into the `listings` slice
-		listings = append(listings, &listing)
+		})
 		return nil
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to walk the filepath for %s: %s", inputDirectoryPath, err)
+		return nil, fmt.Errorf("failed to walk the filesystem at `%s`: %w", root, err)
 	}
 
+	return pending, nil
+}
+
+// readPendingContents reads the content each entry walkFSEntries found still
+// needs (readPath is empty for entries, like bare directories, that already
+// carry their content), up to concurrency at once, preserving pending's
+// order in the returned slice regardless of which read finishes first.
+func readPendingContents(srcFS fs.FS, pending []*pendingFSEntry, concurrency int) ([][]byte, error) {
+	return parallelMap(pending, concurrency, func(p *pendingFSEntry) ([]byte, error) {
+		if p.readPath == "" {
+			return p.fileContent, nil
+		}
+		content, err := fs.ReadFile(srcFS, p.readPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file `%s` with mode %d: %w", p.readPath, p.mode, err)
+		}
+		return content, nil
+	})
+}
+
+// pendingBundle gathers one bundle's concatenated, uncompressed listing
+// content together with the listings packed into it, so aw.codecSelector has
+// something to choose a Codec from before that content is compressed.
+type pendingBundle struct {
+	data     []byte
+	listings []*Listing
+}
+
+// Close packs every queued entry into bundles, compresses them, and writes
+// the finished meta, listing, and bundle headers followed by the data
+// section to the underlying io.Writer. A Writer must not be used again after
+// Close.
+func (aw *Writer) Close() error {
+	if aw.closed {
+		return fmt.Errorf("writer is already closed")
+	}
+	aw.closed = true
+
+	listings := aw.listings
+
 	// Next, we have to sort the listings
 	slices.SortFunc(listings, func(a, b *Listing) int {
 		// First, we sort in ascending order by file size
@@ -233,47 +692,67 @@ func Archive(inputDirectoryPath string) ([]byte, error) {
 	// Bundles are indexed by 0, so we need to add 1 to get the total number of bundles
 	bundlesNeeded := currentBundleIndex + 1
 
-	// Now we can gather up the file contents and prepare them to be turned into bundles
-	uncompressedBundleContents := [][]byte{}
-	for range bundlesNeeded {
-		// We're going to create an empty []byte for each bundle to be filled directly
-		uncompressedBundleContents = append(uncompressedBundleContents, []byte{})
+	// Now we can gather up the file contents, and the listings stored in
+	// each one (so aw.codecSelector can pick a Codec per bundle), and
+	// prepare them to be turned into bundles
+	pendingBundles := make([]*pendingBundle, bundlesNeeded)
+	for i := range pendingBundles {
+		pendingBundles[i] = &pendingBundle{}
 	}
 
 	for _, listing := range listings {
 		// Now, we can directly fill the uncompressed bundle buffers with content directly
-		uncompressedBundleContents[listing.bundleIndex] = append(uncompressedBundleContents[listing.bundleIndex], listing.fileContent...)
+		pending := pendingBundles[listing.bundleIndex]
+		pending.data = append(pending.data, listing.fileContent...)
+		pending.listings = append(pending.listings, listing)
 	}
 
-	// Generate the bundle header info and compress the bundles
-	bundles := []*Bundle{}
-	currentOffsetInDataSection := uint64(0)
-	for i, uncompressedData := range uncompressedBundleContents {
-		// Get the checksum
-		uncompressedChecksum := xxhash3.Hash(uncompressedData)
+	// Compress every bundle, up to aw.concurrency at once; compression is
+	// independent per bundle, so the only thing that has to stay sequential
+	// afterward is assigning each bundle's offsetInDataSection, which depends
+	// on every earlier bundle's compressed size.
+	compressedBundles, err := parallelMap(pendingBundles, aw.concurrency, func(pending *pendingBundle) (*Bundle, error) {
+		uncompressedChecksum := xxhash3.Hash(pending.data)
 
-		// Then, we can compress the bundle
-		compressedBundleData, err := zstd.CompressLevel(nil, uncompressedData, 3)
+		codec := aw.codecSelector(pending.listings)
+		compressedBundleData, err := codec.Compress(pending.data)
 		if err != nil {
-			return nil, fmt.Errorf("failed to compress bundle with index %v: %s", i, err)
+			return nil, fmt.Errorf("failed to compress bundle: %w", err)
 		}
 
-		// Now, we can construct a bundle header struct for the bundle
-		bundleHeaderEntry := Bundle{
-			offsetInDataSection:  currentOffsetInDataSection,
+		return &Bundle{
 			uncompressedChecksum: uncompressedChecksum,
 			compressedSize:       uint64(len(compressedBundleData)),
+			codec:                codec.ID(),
 			data:                 compressedBundleData,
-		}
-
-		// Update the current offset
-		currentOffsetInDataSection += uint64(len(compressedBundleData))
+		}, nil
+	})
+	if err != nil {
+		return err
+	}
 
-		// Push a pointer to the constructed bundle header into the compressed bundles slice
-		bundles = append(bundles, &bundleHeaderEntry)
+	// Generate the bundle header info, in order
+	bundles := []*Bundle{}
+	currentOffsetInDataSection := uint64(0)
+	for _, bundleHeaderEntry := range compressedBundles {
+		bundleHeaderEntry.offsetInDataSection = currentOffsetInDataSection
+		currentOffsetInDataSection += bundleHeaderEntry.compressedSize
+		bundles = append(bundles, bundleHeaderEntry)
 	}
 
-	// Now we can start creating portions of the final archive
+	return writeArchive(aw.w, listings, bundles)
+}
+
+// writeArchive serializes listings and bundles into the meta header, listing
+// header, bundle header, and data section that make up a DeCAF archive's
+// body, then writes the magic number and whole-archive checksum prefix
+// followed by that body to w. Every listing and bundle must already be fully
+// populated, including each bundle's offsetInDataSection; writeArchive only
+// serializes what it's given. It's shared by Writer.Close, which builds
+// listings and bundles fresh from queued entries, and Repack, which reuses
+// bundles (and the listings pointing into them) carried over from an
+// existing archive.
+func writeArchive(w io.Writer, listings []*Listing, bundles []*Bundle) error {
 	// Up first, we'll construct the listing header
 	listingHeaderBuffer := []byte{}
 	for _, listing := range listings {
@@ -292,6 +771,7 @@ func Archive(inputDirectoryPath string) ([]byte, error) {
 		bundleHeaderBuffer = binary.LittleEndian.AppendUint64(bundleHeaderBuffer, bundle.offsetInDataSection)
 		bundleHeaderBuffer = binary.LittleEndian.AppendUint64(bundleHeaderBuffer, bundle.compressedSize)
 		bundleHeaderBuffer = binary.LittleEndian.AppendUint64(bundleHeaderBuffer, bundle.uncompressedChecksum)
+		bundleHeaderBuffer = append(bundleHeaderBuffer, bundle.codec) // the codec ID is only one byte, so it has no endianness
 	}
 
 	// Next, we'll construct the meta header
@@ -304,6 +784,7 @@ func Archive(inputDirectoryPath string) ([]byte, error) {
 	metaHeaderBuffer = binary.LittleEndian.AppendUint64(metaHeaderBuffer, listingHeaderSize)
 	metaHeaderBuffer = binary.LittleEndian.AppendUint64(metaHeaderBuffer, listingCount)
 	metaHeaderBuffer = binary.LittleEndian.AppendUint64(metaHeaderBuffer, bundleCount)
+	metaHeaderBuffer = binary.LittleEndian.AppendUint64(metaHeaderBuffer, currentFormatVersion)
 
 	// Almost there! Now we can build the data section...
 	dataSectionBuffer := []byte{}
@@ -311,85 +792,124 @@ func Archive(inputDirectoryPath string) ([]byte, error) {
 		dataSectionBuffer = append(dataSectionBuffer, bundle.data...)
 	}
 
-	// Finally, we can write the finished archive
-	archive := []byte{}
-
-	// We'll write the header section, which is comprised of the meta, listing, and bundle headers
-	archive = append(archive, metaHeaderBuffer...)
-	archive = append(archive, listingHeaderBuffer...)
-	archive = append(archive, bundleHeaderBuffer...)
-
-	// Then, we can write the data section...
-	archive = append(archive, dataSectionBuffer...)
-
-	// But before we're done, we need to get the checksum of the nearly completed archive
-	archiveChecksum := xxhash3.Hash(archive)
-	// And then prepend the magic number, then the checksum to the archive
-	const magicNumber uint64 = 0x66616365646D6169 // "iamdecaf"
-	prependBuffer := []byte{}
-	prependBuffer = binary.LittleEndian.AppendUint64(prependBuffer, magicNumber)
-	prependBuffer = binary.LittleEndian.AppendUint64(prependBuffer, archiveChecksum)
-	archive = append(prependBuffer, archive...)
-
-	// Et voil√†!
-	return archive, nil
-}
-
-func Unarchive(archive []byte, outputDirectoryPath string) error {
-	magic := binary.LittleEndian.Uint64(archive[0:8])
-	if magic != 0x66616365646D6169 {
-		panic("bad magic")
+	// We still need every header and bundle buffer in memory at once to compute
+	// the whole-archive checksum below, so this doesn't save the memory an
+	// incremental per-entry flush would; it only avoids the extra copy the old
+	// Archive function made by concatenating everything into a second,
+	// returned []byte.
+	body := make([]byte, 0, len(metaHeaderBuffer)+len(listingHeaderBuffer)+len(bundleHeaderBuffer)+len(dataSectionBuffer))
+	body = append(body, metaHeaderBuffer...)
+	body = append(body, listingHeaderBuffer...)
+	body = append(body, bundleHeaderBuffer...)
+	body = append(body, dataSectionBuffer...)
+
+	archiveChecksum := xxhash3.Hash(body)
+
+	var prefix [16]byte
+	binary.LittleEndian.PutUint64(prefix[0:8], magicNumber)
+	binary.LittleEndian.PutUint64(prefix[8:16], archiveChecksum)
+
+	if _, err := w.Write(prefix[:]); err != nil {
+		return fmt.Errorf("failed to write archive prefix: %w", err)
 	}
-	cksumExtracted := binary.LittleEndian.Uint64(archive[8:16])
-	if cksumExtracted != xxhash3.Hash(archive[16:]) {
-		panic("bad archive cksum")
+	if _, err := w.Write(body); err != nil {
+		return fmt.Errorf("failed to write archive body: %w", err)
 	}
 
-	listingHeaderSize := binary.LittleEndian.Uint64(archive[16:24])
-	listingCount := binary.LittleEndian.Uint64(archive[24:32])
-	bundleCount := binary.LittleEndian.Uint64(archive[32:40])
+	return nil
+}
 
-	listingHeaderStartOffset := uint64(40)
-	bundleHeaderStartOffset := listingHeaderStartOffset + listingHeaderSize
-	bundleHeaderSize := bundleCount * 24
-	dataSectionStartOffset := bundleHeaderStartOffset + bundleHeaderSize
+// Header describes a single entry returned by Reader.Next, modeled on
+// archive/tar.Header.
+type Header struct {
+	// Path is the path relative to the apex, which is the root of the archive.
+	Path string
 
-	listingHeader := archive[listingHeaderStartOffset:bundleHeaderStartOffset]
-	bundleHeader := archive[bundleHeaderStartOffset:dataSectionStartOffset]
-	dataSection := archive[dataSectionStartOffset:]
+	// Mode is one of ModeNormal, ModeExecutable, ModeLink, or ModeBareDir.
+	Mode uint8
 
-	bundleHeaderCursor := uint64(0)
-	bundles := []*Bundle{}
-	for range bundleCount {
-		bundleOffsetInDataSection := binary.LittleEndian.Uint64(bundleHeader[bundleHeaderCursor : bundleHeaderCursor+8])
-		bundleCompressedSize := binary.LittleEndian.Uint64(bundleHeader[bundleHeaderCursor+8 : bundleHeaderCursor+16])
-		bundleExpectedChecksum := binary.LittleEndian.Uint64(bundleHeader[bundleHeaderCursor+16 : bundleHeaderCursor+24])
+	// Size is the length in bytes of the entry's content. It is always 0 for
+	// ModeBareDir entries. For a ModeLink entry, Reader.Next reports 0, while
+	// an Index's Entry reports the length of the link target, which is what
+	// Entry.Open yields for it.
+	Size uint64
 
-		bundleHeaderCursor += 24
+	// LinkTarget is the path a ModeLink entry points to, relative to the
+	// apex. It is empty for every other mode.
+	LinkTarget string
+}
 
-		bundleCompressedData := dataSection[bundleOffsetInDataSection : bundleOffsetInDataSection+bundleCompressedSize]
+// Reader reads entries from a DeCAF archive sequentially, modeled on
+// archive/tar.Reader: Next advances to the following entry, and the Reader
+// itself is an io.Reader over that entry's content. Bundles are decompressed
+// lazily as Next reaches a listing stored in them, so a Reader only ever
+// holds one bundle's uncompressed bytes in memory regardless of how large
+// the overall archive is.
+//
+// Reader does not verify the whole-archive checksum stored in the archive's
+// prefix, because doing so would require buffering the entire archive before
+// returning a single byte, defeating the point of streaming. Callers that
+// already hold the full archive in memory, like Unarchive, verify that
+// checksum themselves before constructing a Reader. Per-bundle checksums are
+// still verified as each bundle is decompressed.
+type Reader struct {
+	r io.Reader
+
+	listings []*Listing
+	bundles  []*Bundle
+
+	cursor          int
+	nextBundleIndex uint64
+	currentBundle   []byte
+
+	current *bytes.Reader
+}
 
-		bundleData, err := zstd.Decompress([]byte{}, bundleCompressedData)
-		if err != nil {
-			panic("failed to decompress bundle")
-		}
+// NewReader returns a Reader over an archive, including its magic number and
+// checksum prefix, read sequentially from r.
+func NewReader(r io.Reader) (*Reader, error) {
+	var prefix [16]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, fmt.Errorf("failed to read archive prefix: %w", err)
+	}
+	if binary.LittleEndian.Uint64(prefix[0:8]) != magicNumber {
+		return nil, fmt.Errorf("bad magic number: %w", ErrCorruptHeader)
+	}
 
-		if bundleExpectedChecksum != xxhash3.Hash(bundleData) {
-			panic("bad bundle checksum")
-		}
+	var metaHeader [32]byte
+	if _, err := io.ReadFull(r, metaHeader[:]); err != nil {
+		return nil, fmt.Errorf("failed to read meta header: %w", err)
+	}
+	listingHeaderSize := binary.LittleEndian.Uint64(metaHeader[0:8])
+	listingCount := binary.LittleEndian.Uint64(metaHeader[8:16])
+	bundleCount := binary.LittleEndian.Uint64(metaHeader[16:24])
+	formatVersion := binary.LittleEndian.Uint64(metaHeader[24:32])
+	if formatVersion != currentFormatVersion {
+		return nil, fmt.Errorf("archive format version %d: %w", formatVersion, ErrUnsupportedVersion)
+	}
 
-		bundle := Bundle{
-			offsetInDataSection:  bundleOffsetInDataSection,
-			compressedSize:       bundleCompressedSize,
-			uncompressedChecksum: bundleExpectedChecksum,
-			data:                 bundleData,
-		}
+	listingHeader := make([]byte, listingHeaderSize)
+	if _, err := io.ReadFull(r, listingHeader); err != nil {
+		return nil, fmt.Errorf("failed to read listing header: %w", err)
+	}
 
-		bundles = append(bundles, &bundle)
+	bundleHeader := make([]byte, bundleCount*bundleHeaderEntrySize)
+	if _, err := io.ReadFull(r, bundleHeader); err != nil {
+		return nil, fmt.Errorf("failed to read bundle header: %w", err)
 	}
 
-	listings := []*Listing{}
-	for range listingCount {
+	listings := parseListingHeader(listingHeader, listingCount)
+	bundles := parseBundleHeader(bundleHeader, bundleCount)
+
+	return &Reader{r: r, listings: listings, bundles: bundles}, nil
+}
+
+// parseListingHeader decodes count Listings packed back-to-back in
+// listingHeader, in the format Writer.Close writes them in. It's shared by
+// NewReader and Open.
+func parseListingHeader(listingHeader []byte, count uint64) []*Listing {
+	listings := make([]*Listing, 0, count)
+	for range count {
 		listingLength := binary.LittleEndian.Uint16(listingHeader[:2])
 		listingBundleIndex := binary.LittleEndian.Uint64(listingHeader[2:10])
 		listingBundleOffset := binary.LittleEndian.Uint64(listingHeader[10:18])
@@ -399,15 +919,7 @@ func Unarchive(archive []byte, outputDirectoryPath string) error {
 		listingPath := string(listingHeader[35:listingLength])
 		listingHeader = listingHeader[listingLength:]
 
-		fileContent := []byte{}
-		if listingMode == ModeNormal || listingMode == ModeExecutable || listingMode == ModeLink {
-			fileContent = bundles[listingBundleIndex].data[listingBundleOffset : listingBundleOffset+listingContentSize]
-		}
-		if (listingMode == ModeNormal || listingMode == ModeExecutable) && listingExpectedChecksum != xxhash3.Hash(fileContent) {
-			panic("bad listing checksum")
-		}
-
-		listing := Listing{
+		listings = append(listings, &Listing{
 			totalLength:  listingLength,
 			bundleIndex:  listingBundleIndex,
 			bundleOffset: listingBundleOffset,
@@ -415,66 +927,807 @@ func Unarchive(archive []byte, outputDirectoryPath string) error {
 			checksum:     listingExpectedChecksum,
 			mode:         listingMode,
 			path:         listingPath,
-			fileContent:  fileContent,
+		})
+	}
+	return listings
+}
+
+// parseBundleHeader decodes count Bundles packed back-to-back in
+// bundleHeader, in the format Writer.Close writes them in. It's shared by
+// NewReader and Open.
+func parseBundleHeader(bundleHeader []byte, count uint64) []*Bundle {
+	bundles := make([]*Bundle, 0, count)
+	cursor := 0
+	for range count {
+		bundles = append(bundles, &Bundle{
+			offsetInDataSection:  binary.LittleEndian.Uint64(bundleHeader[cursor : cursor+8]),
+			compressedSize:       binary.LittleEndian.Uint64(bundleHeader[cursor+8 : cursor+16]),
+			uncompressedChecksum: binary.LittleEndian.Uint64(bundleHeader[cursor+16 : cursor+24]),
+			codec:                bundleHeader[cursor+24],
+		})
+		cursor += bundleHeaderEntrySize
+	}
+	return bundles
+}
+
+// Next advances to the next entry in the archive and returns its header. It
+// returns io.EOF once every entry has been read.
+func (ar *Reader) Next() (*Header, error) {
+	if ar.cursor >= len(ar.listings) {
+		return nil, io.EOF
+	}
+	listing := ar.listings[ar.cursor]
+	ar.cursor++
+
+	if listing.mode > ModeBareDir {
+		return nil, &EntryError{Path: listing.path, Op: "read header", Err: ErrUnsupportedVersion}
+	}
+
+	if listing.mode != ModeNormal && listing.mode != ModeExecutable && listing.mode != ModeLink {
+		ar.current = bytes.NewReader(nil)
+		return &Header{Path: listing.path, Mode: listing.mode}, nil
+	}
+
+	if err := ar.ensureBundle(listing.bundleIndex); err != nil {
+		return nil, err
+	}
+	content := ar.currentBundle[listing.bundleOffset : listing.bundleOffset+listing.contentSize]
+	if (listing.mode == ModeNormal || listing.mode == ModeExecutable) && listing.checksum != xxhash3.Hash(content) {
+		return nil, &EntryError{Path: listing.path, Op: "verify checksum", Err: ErrChecksumMismatch}
+	}
+
+	if listing.mode == ModeLink {
+		ar.current = bytes.NewReader(nil)
+		return &Header{Path: listing.path, Mode: listing.mode, LinkTarget: string(content)}, nil
+	}
+
+	ar.current = bytes.NewReader(content)
+	return &Header{Path: listing.path, Mode: listing.mode, Size: listing.contentSize}, nil
+}
+
+// ensureBundle reads and decompresses bundles from the underlying stream, in
+// order, until the bundle at index has been loaded.
+func (ar *Reader) ensureBundle(index uint64) error {
+	for ar.nextBundleIndex <= index {
+		bundle := ar.bundles[ar.nextBundleIndex]
+
+		compressed := make([]byte, bundle.compressedSize)
+		if _, err := io.ReadFull(ar.r, compressed); err != nil {
+			return fmt.Errorf("failed to read bundle %d: %w", ar.nextBundleIndex, err)
+		}
+
+		codec, err := codecByID(bundle.codec)
+		if err != nil {
+			return fmt.Errorf("bundle %d: %w", ar.nextBundleIndex, err)
+		}
+		data, err := codec.Decompress(compressed)
+		if err != nil {
+			return fmt.Errorf("failed to decompress bundle %d: %w", ar.nextBundleIndex, err)
+		}
+		if bundle.uncompressedChecksum != xxhash3.Hash(data) {
+			return fmt.Errorf("bundle %d: %w", ar.nextBundleIndex, ErrChecksumMismatch)
+		}
+
+		ar.currentBundle = data
+		ar.nextBundleIndex++
+	}
+	return nil
+}
+
+// Read reads from the content of the entry most recently returned by Next.
+func (ar *Reader) Read(p []byte) (int, error) {
+	if ar.current == nil {
+		return 0, fmt.Errorf("Read called before Next")
+	}
+	return ar.current.Read(p)
+}
+
+// Index provides random-access reads into a DeCAF archive without requiring
+// the whole thing, or even all of it, to be buffered in memory: Open parses
+// only the meta, listing, and bundle headers up front (typically a tiny
+// fraction of the archive's size), and Entry.Open later seeks directly to
+// and decompresses only the one bundle containing that entry's content.
+//
+// This works within the archive's existing container layout (meta header →
+// listing header → bundle header → concatenated compressed bundles)
+// unchanged, because the bundle header already records every bundle's
+// offset and compressed size in the data section; no footer or seek table
+// needs to be added. The tradeoff is bundle granularity rather than
+// per-file: extracting one small file still decompresses the whole ~10 MiB
+// bundle it happened to be packed into, the same granularity Writer.Close
+// already chooses for everything else.
+type Index struct {
+	r                io.ReaderAt
+	dataSectionStart int64
+
+	listings []*Listing
+	bundles  []*Bundle
+	byPath   map[string]*Listing
+
+	bundleCache *bundleLRU
+}
+
+// bundleLRU caches the N most recently used decompressed bundles, keyed by
+// bundle index, so repeated Entry.Open calls into the same bundle (common
+// when many small files were packed together) don't pay to decompress it
+// again every time. A zero-value bundleLRU (capacity 0) caches nothing,
+// which is the default an Index is constructed with: most one-shot
+// extractions only ever touch each bundle once anyway, so the cache is
+// opt-in via Index.SetCacheSize rather than always-on.
+type bundleLRU struct {
+	capacity int
+	order    []uint64 // most-recently-used last
+	data     map[uint64][]byte
+}
+
+func (c *bundleLRU) get(bundleIndex uint64) ([]byte, bool) {
+	if c == nil || c.capacity == 0 {
+		return nil, false
+	}
+	data, ok := c.data[bundleIndex]
+	if ok {
+		c.touch(bundleIndex)
+	}
+	return data, ok
+}
+
+func (c *bundleLRU) put(bundleIndex uint64, data []byte) {
+	if c == nil || c.capacity == 0 {
+		return
+	}
+	if c.data == nil {
+		c.data = map[uint64][]byte{}
+	}
+	c.data[bundleIndex] = data
+	c.touch(bundleIndex)
+	for len(c.order) > c.capacity {
+		oldest := c.order[0]
+		c.order = c.order[1:]
+		delete(c.data, oldest)
+	}
+}
+
+func (c *bundleLRU) touch(bundleIndex uint64) {
+	for i, idx := range c.order {
+		if idx == bundleIndex {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
 		}
-		listings = append(listings, &listing)
 	}
+	c.order = append(c.order, bundleIndex)
+}
 
-	// Now, we can create the files for all the listings
+// SetCacheSize bounds idx's decompressed-bundle cache to the n most recently
+// used bundles, evicting the least recently used one past that. Zero (the
+// default) disables caching entirely, so Entry.Open always decompresses
+// fresh; a small cache pays off when Extract/OpenFile is called repeatedly
+// against an archive whose files are packed only a handful of bundles.
+func (idx *Index) SetCacheSize(n int) {
+	idx.bundleCache = &bundleLRU{capacity: n}
+}
+
+// Open parses r's headers and returns an Index for random-access reads. size
+// is the total length of the archive, which Open needs to hand out an
+// io.ReaderAt-backed SectionReader for the header section.
+func Open(r io.ReaderAt, size int64) (*Index, error) {
+	if size < 16 {
+		return nil, fmt.Errorf("archive too small to contain a prefix: %w", ErrCorruptHeader)
+	}
+
+	headerReader := io.NewSectionReader(r, 0, size)
+
+	var prefix [16]byte
+	if _, err := io.ReadFull(headerReader, prefix[:]); err != nil {
+		return nil, fmt.Errorf("failed to read archive prefix: %w", err)
+	}
+	if binary.LittleEndian.Uint64(prefix[0:8]) != magicNumber {
+		return nil, fmt.Errorf("bad magic number: %w", ErrCorruptHeader)
+	}
+
+	var metaHeader [32]byte
+	if _, err := io.ReadFull(headerReader, metaHeader[:]); err != nil {
+		return nil, fmt.Errorf("failed to read meta header: %w", err)
+	}
+	listingHeaderSize := binary.LittleEndian.Uint64(metaHeader[0:8])
+	listingCount := binary.LittleEndian.Uint64(metaHeader[8:16])
+	bundleCount := binary.LittleEndian.Uint64(metaHeader[16:24])
+	formatVersion := binary.LittleEndian.Uint64(metaHeader[24:32])
+	if formatVersion != currentFormatVersion {
+		return nil, fmt.Errorf("archive format version %d: %w", formatVersion, ErrUnsupportedVersion)
+	}
+
+	listingHeader := make([]byte, listingHeaderSize)
+	if _, err := io.ReadFull(headerReader, listingHeader); err != nil {
+		return nil, fmt.Errorf("failed to read listing header: %w", err)
+	}
+
+	bundleHeader := make([]byte, bundleCount*bundleHeaderEntrySize)
+	if _, err := io.ReadFull(headerReader, bundleHeader); err != nil {
+		return nil, fmt.Errorf("failed to read bundle header: %w", err)
+	}
+
+	listings := parseListingHeader(listingHeader, listingCount)
+	bundles := parseBundleHeader(bundleHeader, bundleCount)
+
+	dataSectionStart, err := headerReader.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate start of data section: %w", err)
+	}
+
+	byPath := make(map[string]*Listing, len(listings))
 	for _, listing := range listings {
+		byPath[listing.path] = listing
+	}
 
-		// Ensure we're placing files into our new directory
-		listingPath := filepath.Join(outputDirectoryPath, listing.path)
+	return &Index{
+		r:                r,
+		dataSectionStart: dataSectionStart,
+		listings:         listings,
+		bundles:          bundles,
+		byPath:           byPath,
+	}, nil
+}
 
-		// Non-bare directories are created implicitly here
-		listingParentPath := filepath.Dir(listingPath)
-		err := os.MkdirAll(listingParentPath, 0o100755)
+// Entries returns every entry in the archive, in the same order they were
+// written in. Building it doesn't touch any bundle, so it's cheap even for
+// archives with many entries.
+func (idx *Index) Entries() []*Entry {
+	entries := make([]*Entry, 0, len(idx.listings))
+	for _, listing := range idx.listings {
+		entries = append(entries, idx.entryFor(listing))
+	}
+	return entries
+}
+
+// Entry looks up a single entry by its archive-relative path.
+func (idx *Index) Entry(path string) (*Entry, error) {
+	listing, ok := idx.byPath[path]
+	if !ok {
+		return nil, &EntryError{Path: path, Op: "lookup", Err: fs.ErrNotExist}
+	}
+	return idx.entryFor(listing), nil
+}
+
+// bundleContent returns the decompressed, checksum-verified content of
+// bundleIndex, serving it from idx.bundleCache when present there instead of
+// reading and decompressing it again.
+func (idx *Index) bundleContent(bundleIndex uint64) ([]byte, error) {
+	if data, ok := idx.bundleCache.get(bundleIndex); ok {
+		return data, nil
+	}
+
+	bundle := idx.bundles[bundleIndex]
+
+	compressed := make([]byte, bundle.compressedSize)
+	offset := idx.dataSectionStart + int64(bundle.offsetInDataSection)
+	if _, err := idx.r.ReadAt(compressed, offset); err != nil {
+		return nil, fmt.Errorf("failed to read bundle %d: %w", bundleIndex, err)
+	}
+
+	codec, err := codecByID(bundle.codec)
+	if err != nil {
+		return nil, fmt.Errorf("bundle %d: %w", bundleIndex, err)
+	}
+	data, err := codec.Decompress(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress bundle %d: %w", bundleIndex, err)
+	}
+	if bundle.uncompressedChecksum != xxhash3.Hash(data) {
+		return nil, fmt.Errorf("bundle %d: %w", bundleIndex, ErrChecksumMismatch)
+	}
+
+	idx.bundleCache.put(bundleIndex, data)
+	return data, nil
+}
+
+// Files returns every entry in idx, in the same order they were written in.
+// It's an alias for Entries, named to match the archive/zip-style Files /
+// Extract / OpenFile surface random-access callers may already expect.
+func (idx *Index) Files() []*Entry {
+	return idx.Entries()
+}
+
+// Extract looks up path and returns its whole, decompressed content as a
+// []byte. It's a convenience over Entry/Entry.Open for callers that just
+// want one file's bytes without handling an io.ReadCloser themselves.
+func (idx *Index) Extract(path string) ([]byte, error) {
+	entry, err := idx.Entry(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := entry.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// OpenFile looks up path and opens it in one call. It's equivalent to
+// idx.Entry(path) followed by Entry.Open, for callers that don't need the
+// Entry's metadata separately.
+func (idx *Index) OpenFile(path string) (io.ReadCloser, error) {
+	entry, err := idx.Entry(path)
+	if err != nil {
+		return nil, err
+	}
+	return entry.Open()
+}
+
+func (idx *Index) entryFor(listing *Listing) *Entry {
+	return &Entry{
+		Header: Header{
+			Path: listing.path,
+			Mode: listing.mode,
+			Size: listing.contentSize,
+		},
+		idx:     idx,
+		listing: listing,
+	}
+}
+
+// Entry describes a single file within an Index, returned by Entries and
+// Entry. Its LinkTarget is left empty for ModeLink entries until Open is
+// called, since resolving it requires decompressing the entry's bundle, the
+// same cost as reading its content.
+type Entry struct {
+	Header
+	idx     *Index
+	listing *Listing
+}
+
+// Open decompresses the one bundle containing e's content and returns a
+// ReadCloser over it. For a ModeLink entry, the returned reader yields the
+// link's target path rather than file content, same as the target stored in
+// LinkTarget would for an entry read sequentially via Reader.
+func (e *Entry) Open() (io.ReadCloser, error) {
+	if e.listing.mode != ModeNormal && e.listing.mode != ModeExecutable && e.listing.mode != ModeLink {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	data, err := e.idx.bundleContent(e.listing.bundleIndex)
+	if err != nil {
+		return nil, &EntryError{Path: e.listing.path, Op: "read bundle", Err: err}
+	}
+
+	content := data[e.listing.bundleOffset : e.listing.bundleOffset+e.listing.contentSize]
+	if (e.listing.mode == ModeNormal || e.listing.mode == ModeExecutable) && e.listing.checksum != xxhash3.Hash(content) {
+		return nil, &EntryError{Path: e.listing.path, Op: "verify checksum", Err: ErrChecksumMismatch}
+	}
+
+	if e.listing.mode == ModeLink {
+		e.LinkTarget = string(content)
+	}
+
+	return io.NopCloser(bytes.NewReader(content)), nil
+}
+
+// ExtractAllFS materializes every entry in idx through dst, decompressing up
+// to concurrency bundles at once instead of the one-bundle-at-a-time order a
+// sequential Reader enforces. Zero selects runtime.NumCPU(); one forces
+// strictly sequential decompression.
+func (idx *Index) ExtractAllFS(dst WritableFS, concurrency int) error {
+	return idx.extractFiltered(dst, nil, nil, concurrency)
+}
+
+// extractFiltered is the Index-based counterpart to extractFilteredToFS: it
+// decompresses only the bundles a filtered set of entries actually need, up
+// to concurrency at once, then writes every kept entry out. It backs
+// ExtractAllFS (nil filter) and UnarchiveWithOptions when opts.Concurrency
+// requests parallel extraction.
+func (idx *Index) extractFiltered(dst WritableFS, include, exclude []string, concurrency int) error {
+	kept := make([]*Listing, 0, len(idx.listings))
+	neededBundles := map[uint64]bool{}
+	for _, listing := range idx.listings {
+		if listing.mode > ModeBareDir {
+			return &EntryError{Path: listing.path, Op: "read header", Err: ErrUnsupportedVersion}
+		}
+
+		keep, err := matchesFilter(listing.path, include, exclude)
+		if err != nil {
+			return err
+		}
+		if !keep {
+			continue
+		}
+		kept = append(kept, listing)
+		if listing.mode == ModeNormal || listing.mode == ModeExecutable || listing.mode == ModeLink {
+			neededBundles[listing.bundleIndex] = true
+		}
+	}
+
+	bundleIndices := make([]uint64, 0, len(neededBundles))
+	for bundleIndex := range neededBundles {
+		bundleIndices = append(bundleIndices, bundleIndex)
+	}
+
+	decompressedBundles, err := parallelMap(bundleIndices, resolveConcurrency(concurrency), func(bundleIndex uint64) ([]byte, error) {
+		bundle := idx.bundles[bundleIndex]
+
+		compressed := make([]byte, bundle.compressedSize)
+		offset := idx.dataSectionStart + int64(bundle.offsetInDataSection)
+		if _, err := idx.r.ReadAt(compressed, offset); err != nil {
+			return nil, fmt.Errorf("failed to read bundle %d: %w", bundleIndex, err)
+		}
+
+		codec, err := codecByID(bundle.codec)
+		if err != nil {
+			return nil, fmt.Errorf("bundle %d: %w", bundleIndex, err)
+		}
+		data, err := codec.Decompress(compressed)
 		if err != nil {
-			panic(err)
+			return nil, fmt.Errorf("failed to decompress bundle %d: %w", bundleIndex, err)
+		}
+		if bundle.uncompressedChecksum != xxhash3.Hash(data) {
+			return nil, fmt.Errorf("bundle %d: %w", bundleIndex, ErrChecksumMismatch)
+		}
+		return data, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	bundleData := make(map[uint64][]byte, len(bundleIndices))
+	for i, bundleIndex := range bundleIndices {
+		bundleData[bundleIndex] = decompressedBundles[i]
+	}
+
+	for _, listing := range kept {
+		if err := writeListingToFS(listing, bundleData, dst); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeListingToFS materializes a single listing through dst, pulling its
+// content out of bundleData, which must already hold the decompressed bundle
+// listing.bundleIndex refers to. It's the random-access counterpart to the
+// per-entry write inside extractFilteredToFS's Reader-driven loop.
+func writeListingToFS(listing *Listing, bundleData map[uint64][]byte, dst WritableFS) error {
+	if !IsPathSafe(listing.path) {
+		return &EntryError{Path: listing.path, Op: "extract", Err: ErrPathEscape}
+	}
+
+	// Non-bare directories are created implicitly here
+	listingParentPath := pathpkg.Dir(listing.path)
+	if err := dst.MkdirAll(listingParentPath, 0o100755); err != nil {
+		return &EntryError{Path: listing.path, Op: "mkdir", Err: err}
+	}
+
+	// If this listing is a bare directory, we need to create it
+	if listing.mode == ModeBareDir {
+		if err := dst.MkdirAll(listing.path, 0o100755); err != nil {
+			return &EntryError{Path: listing.path, Op: "mkdir", Err: err}
+		}
+		return nil
+	}
+
+	content := bundleData[listing.bundleIndex][listing.bundleOffset : listing.bundleOffset+listing.contentSize]
+	if (listing.mode == ModeNormal || listing.mode == ModeExecutable) && listing.checksum != xxhash3.Hash(content) {
+		return &EntryError{Path: listing.path, Op: "verify checksum", Err: ErrChecksumMismatch}
+	}
+
+	// If this listing is a link, we need to create it as a symlink
+	if listing.mode == ModeLink {
+		if err := dst.Symlink(string(content), listing.path); err != nil {
+			return &EntryError{Path: listing.path, Op: "symlink", Err: err}
+		}
+		return nil
+	}
+
+	// For everything else, we need to actually create a file
+	file, err := dst.Create(listing.path)
+	if err != nil {
+		return &EntryError{Path: listing.path, Op: "create", Err: err}
+	}
+
+	// Set the unix permissions (st_mode)
+	unixMode := fs.FileMode(0o100644)
+	if listing.mode == ModeExecutable {
+		unixMode = 0o100755
+	}
+	if err := dst.Chmod(listing.path, unixMode); err != nil {
+		return &EntryError{Path: listing.path, Op: "chmod", Err: err}
+	}
+
+	if _, err := file.Write(content); err != nil {
+		return &EntryError{Path: listing.path, Op: "write", Err: err}
+	}
+	if err := file.Close(); err != nil {
+		return &EntryError{Path: listing.path, Op: "close", Err: err}
+	}
+
+	return nil
+}
+
+// ExtractTo drains every entry from r, materializing it under
+// outputDirectoryPath. It's a thin wrapper over ExtractToFS backed by an
+// OSFS rooted at outputDirectoryPath.
+func ExtractTo(r *Reader, outputDirectoryPath string) error {
+	return ExtractToFS(r, NewOSFS(outputDirectoryPath))
+}
+
+// ExtractToFS drains every entry from r, materializing it through dst, the
+// same as ExtractTo but against any WritableFS instead of the real
+// filesystem. It's shared by Unarchive/UnarchiveFS and by CLI-style
+// streaming callers that construct their own Reader over an os.File.
+func ExtractToFS(r *Reader, dst WritableFS) error {
+	return extractFilteredToFS(r, dst, nil, nil)
+}
+
+// extractFilteredToFS is ExtractToFS with an additional Include/Exclude
+// filter, matched against each entry's path; it backs both ExtractToFS (with
+// a nil filter) and UnarchiveWithOptions.
+func extractFilteredToFS(r *Reader, dst WritableFS, include, exclude []string) error {
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		keep, err := matchesFilter(hdr.Path, include, exclude)
+		if err != nil {
+			return err
+		}
+		if !keep {
+			continue
+		}
+
+		if !IsPathSafe(hdr.Path) {
+			return &EntryError{Path: hdr.Path, Op: "extract", Err: ErrPathEscape}
+		}
+
+		// Non-bare directories are created implicitly here
+		listingParentPath := pathpkg.Dir(hdr.Path)
+		if err := dst.MkdirAll(listingParentPath, 0o100755); err != nil {
+			return &EntryError{Path: hdr.Path, Op: "mkdir", Err: err}
 		}
 
 		// If this listing is a bare directory, we need to create it
-		if listing.mode == ModeBareDir {
-			err := os.MkdirAll(listingPath, 0o100755)
-			if err != nil {
-				panic(err)
+		if hdr.Mode == ModeBareDir {
+			if err := dst.MkdirAll(hdr.Path, 0o100755); err != nil {
+				return &EntryError{Path: hdr.Path, Op: "mkdir", Err: err}
 			}
 			continue
 		}
 
 		// If this listing is a link, we need to create it as a symlink
-		// The link target is stored in the fileContent
-		if listing.mode == ModeLink {
-			targetPath := string(listing.fileContent)
-			err := os.Symlink(targetPath, listingPath)
-			if err != nil {
-				panic(err)
+		// The link target is stored in the header
+		if hdr.Mode == ModeLink {
+			if err := dst.Symlink(hdr.LinkTarget, hdr.Path); err != nil {
+				return &EntryError{Path: hdr.Path, Op: "symlink", Err: err}
 			}
 			continue
 		}
 
 		// For everything else, we need to actually create a file
-		file, err := os.Create(listingPath)
+		file, err := dst.Create(hdr.Path)
 		if err != nil {
-			panic(err)
+			return &EntryError{Path: hdr.Path, Op: "create", Err: err}
 		}
 
 		// Set the unix permissions (st_mode)
-		unixMode := 0o100644
-		if listing.mode == ModeExecutable {
+		unixMode := fs.FileMode(0o100644)
+		if hdr.Mode == ModeExecutable {
 			unixMode = 0o100755
 		}
-		err = file.Chmod(fs.FileMode(unixMode))
-		if err != nil {
-			panic(err)
+		if err := dst.Chmod(hdr.Path, unixMode); err != nil {
+			return &EntryError{Path: hdr.Path, Op: "chmod", Err: err}
 		}
 
 		// Finally, we fill the file with its content
-		_, err = file.Write(listing.fileContent)
-		if err != nil {
-			panic(err)
+		if _, err := io.Copy(file, r); err != nil {
+			return &EntryError{Path: hdr.Path, Op: "write", Err: err}
+		}
+		if err := file.Close(); err != nil {
+			return &EntryError{Path: hdr.Path, Op: "close", Err: err}
 		}
 	}
 
 	return nil
 }
+
+// Archive is a thin wrapper over Writer that buffers the finished archive in
+// memory and returns it as a []byte. It routes through the default OSFS
+// backend; see ArchiveFS to archive from any other fs.FS.
+func Archive(inputDirectoryPath string) ([]byte, error) {
+	return ArchiveWithOptions(inputDirectoryPath, nil)
+}
+
+// ArchiveTo is a thin wrapper over Writer that streams inputDirectoryPath
+// straight to w instead of buffering the finished archive in memory, for
+// callers archiving a tree too large to hold as one []byte. It's equivalent
+// to constructing a Writer with NewWriter, calling WriteDirectory, and
+// calling Close.
+func ArchiveTo(inputDirectoryPath string, w io.Writer) error {
+	aw, err := NewWriter(w, nil)
+	if err != nil {
+		return err
+	}
+	if err := aw.WriteDirectory(inputDirectoryPath); err != nil {
+		return err
+	}
+	return aw.Close()
+}
+
+// ArchiveWithOptions behaves like Archive, but applies opts' Include/Exclude
+// filtering, FollowSymlinks, and compression settings.
+func ArchiveWithOptions(inputDirectoryPath string, opts *Options) ([]byte, error) {
+	inputDirectoryPath, err := filepath.Abs(inputDirectoryPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make absolute path for path `%s`: %w", inputDirectoryPath, err)
+	}
+
+	return ArchiveFS(NewOSFS(inputDirectoryPath), ".", opts)
+}
+
+// ArchiveFS is a thin wrapper over Writer that archives srcFS starting at
+// root and buffers the finished archive in memory, the same as Archive but
+// against any fs.FS instead of the real filesystem.
+func ArchiveFS(srcFS fs.FS, root string, opts *Options) ([]byte, error) {
+	var buf bytes.Buffer
+
+	aw, err := NewWriter(&buf, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := aw.WriteFS(srcFS, root); err != nil {
+		return nil, err
+	}
+	if err := aw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Unarchive is a thin wrapper over Reader that operates on an archive already
+// held in memory as a []byte, extracting it into the default OSFS backend;
+// see UnarchiveFS to extract into any other WritableFS.
+func Unarchive(archive []byte, outputDirectoryPath string) error {
+	return UnarchiveFS(NewOSFS(outputDirectoryPath), archive)
+}
+
+// UnarchiveFrom is a thin wrapper over Index that extracts an archive
+// without ever requiring it to be read fully into memory: only r's headers
+// are parsed up front, and bundles are decompressed one at a time as their
+// listings are written out, the streaming counterpart to Unarchive/UnarchiveFS
+// for archives read from something seekable, like an os.File, rather than a
+// []byte already held in memory. size is the total length of the archive, the
+// same as Open requires.
+func UnarchiveFrom(r io.ReaderAt, size int64, outputDirectoryPath string) error {
+	idx, err := Open(r, size)
+	if err != nil {
+		return err
+	}
+	idx.SetCacheSize(1) // listings visit bundles in index order, so each is decompressed once
+	for _, listing := range idx.listings {
+		if listing.mode > ModeBareDir {
+			return &EntryError{Path: listing.path, Op: "read header", Err: ErrUnsupportedVersion}
+		}
+		data, err := idx.bundleContent(listing.bundleIndex)
+		if err != nil {
+			return &EntryError{Path: listing.path, Op: "read bundle", Err: err}
+		}
+		if err := writeListingToFS(listing, map[uint64][]byte{listing.bundleIndex: data}, NewOSFS(outputDirectoryPath)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UnarchiveFS is a thin wrapper over Reader that operates on an archive
+// already held in memory as a []byte, the same as Unarchive but extracting
+// into any WritableFS instead of the real filesystem. Because the full
+// archive is available here, it verifies the whole-archive checksum before
+// extracting anything, unlike a Reader fed from a streaming source.
+func UnarchiveFS(dst WritableFS, archive []byte) error {
+	r, err := newVerifiedReader(archive)
+	if err != nil {
+		return err
+	}
+
+	return ExtractToFS(r, dst)
+}
+
+// UnarchiveOptions configures UnarchiveWithOptions, letting callers extract
+// only a subset of an archive's entries.
+type UnarchiveOptions struct {
+	// Include, if non-empty, restricts extraction to entries whose path
+	// matches at least one of these double-star glob patterns (see
+	// github.com/bmatcuk/doublestar). A nil or empty Include extracts
+	// everything.
+	Include []string
+
+	// Exclude skips entries whose path matches any of these double-star
+	// glob patterns, applied after Include.
+	Exclude []string
+
+	// Concurrency bounds how many bundles are decompressed at once. Zero
+	// selects runtime.NumCPU(); one extracts sequentially, bundle by bundle,
+	// the same as the plain Reader-based path Unarchive and UnarchiveFS use.
+	Concurrency int
+}
+
+// UnarchiveWithOptions behaves like Unarchive, but only extracts entries
+// passing opts' Include/Exclude filters, letting callers pull a single
+// subtree or glob (e.g. "**/*.go") out of an archive without materializing
+// the rest. Any opts.Concurrency other than one, including the zero default,
+// decompresses multiple bundles at once via Index instead of draining a
+// single Reader stream in bundle order.
+func UnarchiveWithOptions(archive []byte, outputDirectoryPath string, opts UnarchiveOptions) error {
+	if opts.Concurrency != 1 {
+		// newVerifiedReader's only job here is the magic number and
+		// whole-archive checksum check every other in-memory entry point
+		// performs; the Reader it returns goes unused in favor of Index,
+		// which decompresses bundles out of order.
+		if _, err := newVerifiedReader(archive); err != nil {
+			return err
+		}
+
+		idx, err := Open(bytes.NewReader(archive), int64(len(archive)))
+		if err != nil {
+			return err
+		}
+		return idx.extractFiltered(NewOSFS(outputDirectoryPath), opts.Include, opts.Exclude, opts.Concurrency)
+	}
+
+	r, err := newVerifiedReader(archive)
+	if err != nil {
+		return err
+	}
+
+	return extractFilteredToFS(r, NewOSFS(outputDirectoryPath), opts.Include, opts.Exclude)
+}
+
+// newVerifiedReader checks an in-memory archive's magic number and
+// whole-archive checksum, then returns a Reader over it. It's shared by
+// every entry point that already holds the full archive in memory, unlike a
+// Reader fed from a streaming source, which can't verify the checksum
+// without buffering everything first.
+func newVerifiedReader(archive []byte) (*Reader, error) {
+	if len(archive) < 16 {
+		return nil, fmt.Errorf("archive too small to contain a prefix: %w", ErrCorruptHeader)
+	}
+	if binary.LittleEndian.Uint64(archive[0:8]) != magicNumber {
+		return nil, fmt.Errorf("bad magic number: %w", ErrCorruptHeader)
+	}
+	if binary.LittleEndian.Uint64(archive[8:16]) != xxhash3.Hash(archive[16:]) {
+		return nil, fmt.Errorf("whole-archive checksum: %w", ErrChecksumMismatch)
+	}
+
+	r, err := NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+	return r, nil
+}
+
+// EntryInfo describes a single archived entry, returned by ListEntries so
+// callers can preview an archive's contents without extracting anything.
+type EntryInfo struct {
+	Path string
+	Mode uint8
+	Size uint64
+}
+
+// ListEntries parses archive's meta, listing, and bundle headers and returns
+// an EntryInfo for every entry, without decompressing a single bundle.
+func ListEntries(archive []byte) ([]EntryInfo, error) {
+	r, err := newVerifiedReader(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]EntryInfo, 0, len(r.listings))
+	for _, listing := range r.listings {
+		entries = append(entries, EntryInfo{Path: listing.path, Mode: listing.mode, Size: listing.contentSize})
+	}
+	return entries, nil
+}
@@ -0,0 +1,748 @@
+package decaf_reference
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	pathpkg "path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/DataDog/zstd"
+	"github.com/bytedance/gopkg/util/xxhash3"
+)
+
+// magicNumberChunked identifies the first 8 bytes of a content-defined-chunked
+// DeCAF archive, spelling "iamdecf2". It's a distinct magic number from
+// magicNumber because the two formats aren't interchangeable: a chunked
+// archive's listings point into a chunk table rather than directly into a
+// bundle, and an unmodified Reader or Index has no way to resolve that extra
+// indirection.
+//
+// The chunked archive's layout extends the original one with a chunk table
+// section, inserted between the listing header and the bundle header:
+//
+//	prefix (16) -> meta header (32) -> listing header -> chunk table -> bundle header -> data section
+//
+// The prefix keeps its original layout. The meta header holds
+// listingHeaderSize, listingCount, chunkCount, and bundleCount, with no
+// formatVersion. Each bundle header entry is 24 bytes (offsetInDataSection,
+// compressedSize, uncompressedChecksum) with no codec byte, since every
+// bundle is zstd. Listing entries carry a slice of chunk references instead
+// of a single (bundleIndex, bundleOffset, contentSize) tuple. See
+// chunkedListing and chunkTableEntry for the new per-section formats.
+const magicNumberChunked uint64 = 0x32666365646D6169
+
+// minChunkSize, maxChunkSize, and chunkMaskBits parameterize the
+// content-defined chunker in cdcChunks: chunks are never smaller than
+// minChunkSize or larger than maxChunkSize, and chunkMaskBits controls the
+// average chunk size in between (2^chunkMaskBits bytes, ~1 MiB here).
+const (
+	minChunkSize  = 64 * 1024
+	maxChunkSize  = 4 * 1024 * 1024
+	chunkMaskBits = 20
+)
+
+// gearTable is the per-byte table a gear hash mixes into its rolling state.
+// It's derived from xxhash3.Hash rather than hardcoded or randomly generated,
+// so the chunker stays fully deterministic (same input always splits into
+// the same chunks) without pulling in a new dependency just for the table.
+var gearTable [256]uint64
+
+func init() {
+	for i := range gearTable {
+		gearTable[i] = xxhash3.Hash([]byte{byte(i)})
+	}
+}
+
+// cdcChunkRange is a content-defined chunk's span within the []byte it was
+// cut from, before it's deduplicated or assigned to a bundle.
+type cdcChunkRange struct {
+	offset int
+	length int
+}
+
+// cdcChunks splits data into content-defined chunks using a gear hash: a
+// chunk boundary falls wherever the rolling hash's low chunkMaskBits bits are
+// all zero, so the same byte sequence always cuts at the same place
+// regardless of what precedes it elsewhere in the archive, which is what
+// makes cross-file deduplication possible. Boundaries are also forced at
+// maxChunkSize to bound worst-case memory, and never considered before
+// minChunkSize to avoid pathologically small chunks. Empty data yields no
+// chunks.
+func cdcChunks(data []byte) []cdcChunkRange {
+	if len(data) == 0 {
+		return nil
+	}
+
+	const mask = uint64(1)<<chunkMaskBits - 1
+
+	var ranges []cdcChunkRange
+	start := 0
+	var h uint64
+	for i, b := range data {
+		h = (h << 1) + gearTable[b]
+		size := i + 1 - start
+		if (size >= minChunkSize && h&mask == 0) || size >= maxChunkSize || i == len(data)-1 {
+			ranges = append(ranges, cdcChunkRange{offset: start, length: size})
+			start = i + 1
+			h = 0
+		}
+	}
+	return ranges
+}
+
+// chunkRef points a chunkedListing at one of its content's chunks: chunkIndex
+// names the chunk in the archive's chunk table, and byteOffset/byteLength
+// select the span of that chunk's content this listing is made of. Every
+// chunk cdcChunks produces is consumed by exactly one listing in full, so
+// byteOffset is always 0 and byteLength always the chunk's whole length; the
+// fields stay independent of the chunk table entry's own length so that a
+// future repack that further splits or reuses part of a chunk doesn't need a
+// format change.
+type chunkRef struct {
+	chunkIndex uint64
+	byteOffset uint64
+	byteLength uint64
+}
+
+// chunkedListing is the chunked format's counterpart to Listing: the same
+// per-entry metadata, but pointing at a slice of chunkRefs instead of a
+// single bundle location.
+type chunkedListing struct {
+	totalLength uint16
+	mode        uint8
+	path        string
+	contentSize uint64
+	checksum    uint64 // XXH3-64 of the entry's whole, reassembled content
+	chunks      []chunkRef
+
+	// fileContent is only populated while the archive is being built by
+	// ChunkedWriter, the same as Listing.fileContent.
+	fileContent []byte
+}
+
+// chunkTableEntry records where one unique chunk's compressed bytes live: the
+// bundle it was packed into, its offset within that bundle's uncompressed
+// data, its uncompressed length, and the XXH3-128 checksum of its content, by
+// which chunks are deduplicated across every entry in the archive.
+type chunkTableEntry struct {
+	checksum     [2]uint64
+	bundleIndex  uint64
+	bundleOffset uint64
+	length       uint64
+}
+
+// ChunkedWriter assembles a content-defined-chunked DeCAF archive, the same
+// role Writer plays for the original format. Identical file content, even
+// across unrelated files, is only ever compressed and stored once: every
+// entry's content is split into content-defined chunks, and chunks already
+// seen from an earlier entry are reused by reference instead of being
+// packed into a bundle again.
+type ChunkedWriter struct {
+	w              io.Writer
+	level          int
+	include        []string
+	exclude        []string
+	followSymlinks bool
+	concurrency    int
+	listings       []*chunkedListing
+	closed         bool
+}
+
+// NewChunkedWriter returns a ChunkedWriter that streams a chunked DeCAF
+// archive to w as WriteDirectory and Close are called. opts behaves the same
+// as it does for NewWriter, except that Codec and CodecSelector are ignored:
+// every bundle is compressed with zstd at CompressionLevel.
+func NewChunkedWriter(w io.Writer, opts *Options) (*ChunkedWriter, error) {
+	level := 3
+	cw := &ChunkedWriter{w: w, concurrency: resolveConcurrency(0)}
+	if opts != nil {
+		if opts.CompressionLevel != 0 {
+			level = opts.CompressionLevel
+		}
+		cw.include = opts.Include
+		cw.exclude = opts.Exclude
+		cw.followSymlinks = opts.FollowSymlinks
+		cw.concurrency = resolveConcurrency(opts.Concurrency)
+	}
+	cw.level = level
+	return cw, nil
+}
+
+// WriteDirectory walks inputDirectoryPath on the real filesystem and queues
+// every entry it finds for writing, the chunked counterpart to
+// Writer.WriteDirectory.
+func (cw *ChunkedWriter) WriteDirectory(inputDirectoryPath string) error {
+	inputDirectoryPath, err := filepath.Abs(inputDirectoryPath)
+	if err != nil {
+		return fmt.Errorf("failed to make absolute path for path `%s`: %w", inputDirectoryPath, err)
+	}
+
+	return cw.WriteFS(NewOSFS(inputDirectoryPath), ".")
+}
+
+// WriteFS walks srcFS starting at root and queues every entry it finds for
+// writing, the chunked counterpart to Writer.WriteFS. The walk and the
+// parallel content reads it feeds are shared with Writer via walkFSEntries
+// and readPendingContents; only how a read entry's bytes turn into a listing
+// differs, since here content is split into chunks rather than packed
+// straight into a bundle.
+func (cw *ChunkedWriter) WriteFS(srcFS fs.FS, root string) error {
+	pending, err := walkFSEntries(srcFS, root, cw.followSymlinks, cw.include, cw.exclude)
+	if err != nil {
+		return err
+	}
+
+	contents, err := readPendingContents(srcFS, pending, cw.concurrency)
+	if err != nil {
+		return err
+	}
+
+	for i, p := range pending {
+		fileContent := contents[i]
+		contentChecksum := uint64(0)
+		if p.mode == ModeNormal || p.mode == ModeExecutable {
+			contentChecksum = xxhash3.Hash(fileContent)
+		}
+
+		cw.listings = append(cw.listings, &chunkedListing{
+			path:        p.path,
+			contentSize: uint64(len(fileContent)),
+			checksum:    contentChecksum,
+			mode:        p.mode,
+			fileContent: fileContent,
+		})
+	}
+
+	return nil
+}
+
+// Close cuts every queued entry's content into content-defined chunks,
+// deduplicates them globally by XXH3-128, packs the unique chunks into
+// bundles, compresses those bundles, and writes the finished archive to the
+// underlying io.Writer. A ChunkedWriter must not be used again after Close.
+func (cw *ChunkedWriter) Close() error {
+	if cw.closed {
+		return fmt.Errorf("writer is already closed")
+	}
+	cw.closed = true
+
+	listings := cw.listings
+
+	// Sort for the same reason Writer.Close does: a deterministic listing
+	// order independent of walk or worker scheduling order. Unlike
+	// Writer.Close, this sorts by path alone.
+	slices.SortFunc(listings, func(a, b *chunkedListing) int {
+		if a.path != b.path {
+			return strings.Compare(a.path, b.path)
+		}
+		panic("Encountered unsortable files!")
+	})
+
+	chunkIndexByChecksum := map[[2]uint64]uint64{}
+	var uniqueChunks [][]byte
+	var uniqueChunkChecksums [][2]uint64
+
+	for _, listing := range listings {
+		if listing.mode == ModeBareDir {
+			continue
+		}
+		for _, r := range cdcChunks(listing.fileContent) {
+			chunkBytes := listing.fileContent[r.offset : r.offset+r.length]
+			checksum := xxhash3.Hash128(chunkBytes)
+
+			chunkIndex, seen := chunkIndexByChecksum[checksum]
+			if !seen {
+				chunkIndex = uint64(len(uniqueChunks))
+				chunkIndexByChecksum[checksum] = chunkIndex
+				uniqueChunks = append(uniqueChunks, chunkBytes)
+				uniqueChunkChecksums = append(uniqueChunkChecksums, checksum)
+			}
+
+			listing.chunks = append(listing.chunks, chunkRef{
+				chunkIndex: chunkIndex,
+				byteOffset: 0,
+				byteLength: uint64(r.length),
+			})
+		}
+	}
+
+	// Pack unique chunks into bundles, the same target-size-then-advance
+	// scheme Writer.Close uses for whole files.
+	const targetBundleSize = 10 * (1024 * 1024)
+	chunkEntries := make([]chunkTableEntry, len(uniqueChunks))
+	uncompressedBundleContents := [][]byte{}
+	currentBundleIndex := uint64(0)
+	currentBundleSize := uint64(0)
+	uncompressedBundleContents = append(uncompressedBundleContents, []byte{})
+	for i, chunkBytes := range uniqueChunks {
+		if currentBundleSize > targetBundleSize {
+			currentBundleIndex++
+			currentBundleSize = 0
+			uncompressedBundleContents = append(uncompressedBundleContents, []byte{})
+		}
+
+		chunkEntries[i] = chunkTableEntry{
+			checksum:     uniqueChunkChecksums[i],
+			bundleIndex:  currentBundleIndex,
+			bundleOffset: currentBundleSize,
+			length:       uint64(len(chunkBytes)),
+		}
+		uncompressedBundleContents[currentBundleIndex] = append(uncompressedBundleContents[currentBundleIndex], chunkBytes...)
+		currentBundleSize += uint64(len(chunkBytes))
+	}
+
+	compressedBundles, err := parallelMap(uncompressedBundleContents, cw.concurrency, func(uncompressedData []byte) (*Bundle, error) {
+		uncompressedChecksum := xxhash3.Hash(uncompressedData)
+
+		compressedBundleData, err := zstd.CompressLevel(nil, uncompressedData, cw.level)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compress bundle: %w", err)
+		}
+
+		return &Bundle{
+			uncompressedChecksum: uncompressedChecksum,
+			compressedSize:       uint64(len(compressedBundleData)),
+			data:                 compressedBundleData,
+		}, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	bundles := []*Bundle{}
+	currentOffsetInDataSection := uint64(0)
+	for _, bundleHeaderEntry := range compressedBundles {
+		bundleHeaderEntry.offsetInDataSection = currentOffsetInDataSection
+		currentOffsetInDataSection += bundleHeaderEntry.compressedSize
+		bundles = append(bundles, bundleHeaderEntry)
+	}
+
+	// Listing header: totalLength, mode, contentSize, checksum, chunkCount,
+	// path, then chunkCount chunkRefs.
+	listingHeaderBuffer := []byte{}
+	for _, listing := range listings {
+		listing.totalLength = uint16(23 + len(listing.path) + len(listing.chunks)*24)
+
+		listingHeaderBuffer = binary.LittleEndian.AppendUint16(listingHeaderBuffer, listing.totalLength)
+		listingHeaderBuffer = append(listingHeaderBuffer, listing.mode)
+		listingHeaderBuffer = binary.LittleEndian.AppendUint64(listingHeaderBuffer, listing.contentSize)
+		listingHeaderBuffer = binary.LittleEndian.AppendUint64(listingHeaderBuffer, listing.checksum)
+		listingHeaderBuffer = binary.LittleEndian.AppendUint32(listingHeaderBuffer, uint32(len(listing.chunks)))
+		listingHeaderBuffer = append(listingHeaderBuffer, []byte(listing.path)...)
+		for _, c := range listing.chunks {
+			listingHeaderBuffer = binary.LittleEndian.AppendUint64(listingHeaderBuffer, c.chunkIndex)
+			listingHeaderBuffer = binary.LittleEndian.AppendUint64(listingHeaderBuffer, c.byteOffset)
+			listingHeaderBuffer = binary.LittleEndian.AppendUint64(listingHeaderBuffer, c.byteLength)
+		}
+	}
+
+	chunkTableBuffer := []byte{}
+	for _, entry := range chunkEntries {
+		chunkTableBuffer = binary.LittleEndian.AppendUint64(chunkTableBuffer, entry.checksum[0])
+		chunkTableBuffer = binary.LittleEndian.AppendUint64(chunkTableBuffer, entry.checksum[1])
+		chunkTableBuffer = binary.LittleEndian.AppendUint64(chunkTableBuffer, entry.bundleIndex)
+		chunkTableBuffer = binary.LittleEndian.AppendUint64(chunkTableBuffer, entry.bundleOffset)
+		chunkTableBuffer = binary.LittleEndian.AppendUint64(chunkTableBuffer, entry.length)
+	}
+
+	bundleHeaderBuffer := []byte{}
+	for _, bundle := range bundles {
+		bundleHeaderBuffer = binary.LittleEndian.AppendUint64(bundleHeaderBuffer, bundle.offsetInDataSection)
+		bundleHeaderBuffer = binary.LittleEndian.AppendUint64(bundleHeaderBuffer, bundle.compressedSize)
+		bundleHeaderBuffer = binary.LittleEndian.AppendUint64(bundleHeaderBuffer, bundle.uncompressedChecksum)
+	}
+
+	metaHeaderBuffer := []byte{}
+	metaHeaderBuffer = binary.LittleEndian.AppendUint64(metaHeaderBuffer, uint64(len(listingHeaderBuffer)))
+	metaHeaderBuffer = binary.LittleEndian.AppendUint64(metaHeaderBuffer, uint64(len(listings)))
+	metaHeaderBuffer = binary.LittleEndian.AppendUint64(metaHeaderBuffer, uint64(len(chunkEntries)))
+	metaHeaderBuffer = binary.LittleEndian.AppendUint64(metaHeaderBuffer, uint64(len(bundles)))
+
+	dataSectionBuffer := []byte{}
+	for _, bundle := range bundles {
+		dataSectionBuffer = append(dataSectionBuffer, bundle.data...)
+	}
+
+	body := make([]byte, 0, len(metaHeaderBuffer)+len(listingHeaderBuffer)+len(chunkTableBuffer)+len(bundleHeaderBuffer)+len(dataSectionBuffer))
+	body = append(body, metaHeaderBuffer...)
+	body = append(body, listingHeaderBuffer...)
+	body = append(body, chunkTableBuffer...)
+	body = append(body, bundleHeaderBuffer...)
+	body = append(body, dataSectionBuffer...)
+
+	archiveChecksum := xxhash3.Hash(body)
+
+	var prefix [16]byte
+	binary.LittleEndian.PutUint64(prefix[0:8], magicNumberChunked)
+	binary.LittleEndian.PutUint64(prefix[8:16], archiveChecksum)
+
+	if _, err := cw.w.Write(prefix[:]); err != nil {
+		return fmt.Errorf("failed to write archive prefix: %w", err)
+	}
+	if _, err := cw.w.Write(body); err != nil {
+		return fmt.Errorf("failed to write archive body: %w", err)
+	}
+
+	return nil
+}
+
+// ChunkedIndex provides random-access reads into a chunked DeCAF archive,
+// the chunked counterpart to Index. Open parses the meta, listing, chunk
+// table, and bundle headers up front; Entry.Open reconstructs an entry's
+// content by decompressing the bundle each of its chunks lives in (caching
+// each bundle the first time it's needed) and concatenating the chunks'
+// byte ranges in order.
+//
+// There's no chunked counterpart to the sequential Reader: because chunks
+// are deduplicated across the whole archive, an entry late in listing order
+// can depend on a chunk packed into an early bundle that a different entry
+// already consumed, so entries can't be reconstructed by reading bundles
+// forward in a single pass the way Reader does for the unchunked format.
+type ChunkedIndex struct {
+	r                io.ReaderAt
+	dataSectionStart int64
+
+	listings []*chunkedListing
+	chunks   []chunkTableEntry
+	bundles  []*Bundle
+	byPath   map[string]*chunkedListing
+
+	bundleCache map[uint64][]byte
+}
+
+// OpenChunked parses r's headers and returns a ChunkedIndex for random-access
+// reads. size is the total length of the archive.
+func OpenChunked(r io.ReaderAt, size int64) (*ChunkedIndex, error) {
+	if size < 16 {
+		return nil, fmt.Errorf("archive too small to contain a prefix: %w", ErrCorruptHeader)
+	}
+
+	headerReader := io.NewSectionReader(r, 0, size)
+
+	var prefix [16]byte
+	if _, err := io.ReadFull(headerReader, prefix[:]); err != nil {
+		return nil, fmt.Errorf("failed to read archive prefix: %w", err)
+	}
+	if binary.LittleEndian.Uint64(prefix[0:8]) != magicNumberChunked {
+		return nil, fmt.Errorf("bad magic number: %w", ErrCorruptHeader)
+	}
+
+	var metaHeader [32]byte
+	if _, err := io.ReadFull(headerReader, metaHeader[:]); err != nil {
+		return nil, fmt.Errorf("failed to read meta header: %w", err)
+	}
+	listingHeaderSize := binary.LittleEndian.Uint64(metaHeader[0:8])
+	listingCount := binary.LittleEndian.Uint64(metaHeader[8:16])
+	chunkCount := binary.LittleEndian.Uint64(metaHeader[16:24])
+	bundleCount := binary.LittleEndian.Uint64(metaHeader[24:32])
+
+	listingHeader := make([]byte, listingHeaderSize)
+	if _, err := io.ReadFull(headerReader, listingHeader); err != nil {
+		return nil, fmt.Errorf("failed to read listing header: %w", err)
+	}
+
+	chunkTableBuffer := make([]byte, chunkCount*40)
+	if _, err := io.ReadFull(headerReader, chunkTableBuffer); err != nil {
+		return nil, fmt.Errorf("failed to read chunk table: %w", err)
+	}
+
+	bundleHeader := make([]byte, bundleCount*24)
+	if _, err := io.ReadFull(headerReader, bundleHeader); err != nil {
+		return nil, fmt.Errorf("failed to read bundle header: %w", err)
+	}
+
+	listings, err := parseChunkedListingHeader(listingHeader, listingCount)
+	if err != nil {
+		return nil, err
+	}
+	chunks := parseChunkTable(chunkTableBuffer, chunkCount)
+	bundles := parseChunkedBundleHeader(bundleHeader, bundleCount)
+
+	dataSectionStart, err := headerReader.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate start of data section: %w", err)
+	}
+
+	byPath := make(map[string]*chunkedListing, len(listings))
+	for _, listing := range listings {
+		byPath[listing.path] = listing
+	}
+
+	return &ChunkedIndex{
+		r:                r,
+		dataSectionStart: dataSectionStart,
+		listings:         listings,
+		chunks:           chunks,
+		bundles:          bundles,
+		byPath:           byPath,
+		bundleCache:      map[uint64][]byte{},
+	}, nil
+}
+
+// parseChunkedListingHeader decodes count chunkedListings packed back-to-back
+// in listingHeader, in the format ChunkedWriter.Close writes them in.
+func parseChunkedListingHeader(listingHeader []byte, count uint64) ([]*chunkedListing, error) {
+	listings := make([]*chunkedListing, 0, count)
+	for range count {
+		if len(listingHeader) < 23 {
+			return nil, fmt.Errorf("truncated listing entry: %w", ErrCorruptHeader)
+		}
+		totalLength := binary.LittleEndian.Uint16(listingHeader[0:2])
+		mode := listingHeader[2]
+		contentSize := binary.LittleEndian.Uint64(listingHeader[3:11])
+		checksum := binary.LittleEndian.Uint64(listingHeader[11:19])
+		chunkCount := binary.LittleEndian.Uint32(listingHeader[19:23])
+		pathEnd := 23 + int(totalLength) - 23 - int(chunkCount)*24
+		path := string(listingHeader[23:pathEnd])
+
+		chunks := make([]chunkRef, 0, chunkCount)
+		cursor := pathEnd
+		for range chunkCount {
+			chunks = append(chunks, chunkRef{
+				chunkIndex: binary.LittleEndian.Uint64(listingHeader[cursor : cursor+8]),
+				byteOffset: binary.LittleEndian.Uint64(listingHeader[cursor+8 : cursor+16]),
+				byteLength: binary.LittleEndian.Uint64(listingHeader[cursor+16 : cursor+24]),
+			})
+			cursor += 24
+		}
+
+		listings = append(listings, &chunkedListing{
+			totalLength: totalLength,
+			mode:        mode,
+			path:        path,
+			contentSize: contentSize,
+			checksum:    checksum,
+			chunks:      chunks,
+		})
+
+		listingHeader = listingHeader[totalLength:]
+	}
+	return listings, nil
+}
+
+// parseChunkTable decodes count chunkTableEntries packed back-to-back in
+// buf, in the format ChunkedWriter.Close writes them in.
+func parseChunkTable(buf []byte, count uint64) []chunkTableEntry {
+	entries := make([]chunkTableEntry, 0, count)
+	cursor := 0
+	for range count {
+		entries = append(entries, chunkTableEntry{
+			checksum: [2]uint64{
+				binary.LittleEndian.Uint64(buf[cursor : cursor+8]),
+				binary.LittleEndian.Uint64(buf[cursor+8 : cursor+16]),
+			},
+			bundleIndex:  binary.LittleEndian.Uint64(buf[cursor+16 : cursor+24]),
+			bundleOffset: binary.LittleEndian.Uint64(buf[cursor+24 : cursor+32]),
+			length:       binary.LittleEndian.Uint64(buf[cursor+32 : cursor+40]),
+		})
+		cursor += 40
+	}
+	return entries
+}
+
+// parseChunkedBundleHeader decodes count Bundles packed back-to-back in
+// bundleHeader, in the format ChunkedWriter.Close writes them in. Unlike the
+// original format's parseBundleHeader, this doesn't expect a per-bundle
+// codec byte: the chunked format always compresses bundles with zstd, so
+// Bundle.codec is left at its zero value (codecZstd) on every entry.
+func parseChunkedBundleHeader(bundleHeader []byte, count uint64) []*Bundle {
+	bundles := make([]*Bundle, 0, count)
+	cursor := 0
+	for range count {
+		bundles = append(bundles, &Bundle{
+			offsetInDataSection:  binary.LittleEndian.Uint64(bundleHeader[cursor : cursor+8]),
+			compressedSize:       binary.LittleEndian.Uint64(bundleHeader[cursor+8 : cursor+16]),
+			uncompressedChecksum: binary.LittleEndian.Uint64(bundleHeader[cursor+16 : cursor+24]),
+		})
+		cursor += 24
+	}
+	return bundles
+}
+
+// Entries returns every entry in idx, in the same order they were
+// written in.
+func (idx *ChunkedIndex) Entries() []*Header {
+	headers := make([]*Header, 0, len(idx.listings))
+	for _, listing := range idx.listings {
+		headers = append(headers, &Header{Path: listing.path, Mode: listing.mode, Size: listing.contentSize})
+	}
+	return headers
+}
+
+// Open reconstructs and returns the content of the entry at path, looking up
+// and decompressing (or reusing already-cached) bundles for each of its
+// chunks in turn. For a ModeLink entry, the returned bytes are the link's
+// target path, the same convention Reader and Index use.
+func (idx *ChunkedIndex) Open(path string) (io.ReadCloser, error) {
+	listing, ok := idx.byPath[path]
+	if !ok {
+		return nil, &EntryError{Path: path, Op: "lookup", Err: fs.ErrNotExist}
+	}
+
+	if listing.mode == ModeBareDir {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	content := make([]byte, 0, listing.contentSize)
+	for _, ref := range listing.chunks {
+		chunkData, err := idx.chunkContent(ref.chunkIndex)
+		if err != nil {
+			return nil, &EntryError{Path: listing.path, Op: "read chunk", Err: err}
+		}
+		content = append(content, chunkData[ref.byteOffset:ref.byteOffset+ref.byteLength]...)
+	}
+
+	if (listing.mode == ModeNormal || listing.mode == ModeExecutable) && listing.checksum != xxhash3.Hash(content) {
+		return nil, &EntryError{Path: listing.path, Op: "verify checksum", Err: ErrChecksumMismatch}
+	}
+
+	return io.NopCloser(bytes.NewReader(content)), nil
+}
+
+// chunkContent returns the decompressed bytes of the unique chunk at
+// chunkIndex, decompressing and verifying its bundle the first time any
+// chunk from it is needed, and reusing that decompressed bundle for every
+// later lookup into it.
+func (idx *ChunkedIndex) chunkContent(chunkIndex uint64) ([]byte, error) {
+	entry := idx.chunks[chunkIndex]
+
+	bundleData, ok := idx.bundleCache[entry.bundleIndex]
+	if !ok {
+		bundle := idx.bundles[entry.bundleIndex]
+
+		compressed := make([]byte, bundle.compressedSize)
+		offset := idx.dataSectionStart + int64(bundle.offsetInDataSection)
+		if _, err := idx.r.ReadAt(compressed, offset); err != nil {
+			return nil, fmt.Errorf("failed to read bundle %d: %w", entry.bundleIndex, err)
+		}
+
+		data, err := zstd.Decompress(nil, compressed)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress bundle %d: %w", entry.bundleIndex, err)
+		}
+		if bundle.uncompressedChecksum != xxhash3.Hash(data) {
+			return nil, fmt.Errorf("bundle %d: %w", entry.bundleIndex, ErrChecksumMismatch)
+		}
+
+		bundleData = data
+		idx.bundleCache[entry.bundleIndex] = bundleData
+	}
+
+	return bundleData[entry.bundleOffset : entry.bundleOffset+entry.length], nil
+}
+
+// ExtractAllFS materializes every entry in idx through dst.
+func (idx *ChunkedIndex) ExtractAllFS(dst WritableFS) error {
+	for _, listing := range idx.listings {
+		if !IsPathSafe(listing.path) {
+			return &EntryError{Path: listing.path, Op: "extract", Err: ErrPathEscape}
+		}
+
+		listingParentPath := pathpkg.Dir(listing.path)
+		if err := dst.MkdirAll(listingParentPath, 0o100755); err != nil {
+			return &EntryError{Path: listing.path, Op: "mkdir", Err: err}
+		}
+
+		if listing.mode == ModeBareDir {
+			if err := dst.MkdirAll(listing.path, 0o100755); err != nil {
+				return &EntryError{Path: listing.path, Op: "mkdir", Err: err}
+			}
+			continue
+		}
+
+		content, err := idx.Open(listing.path)
+		if err != nil {
+			return err
+		}
+
+		if listing.mode == ModeLink {
+			target, err := io.ReadAll(content)
+			content.Close()
+			if err != nil {
+				return &EntryError{Path: listing.path, Op: "read chunk", Err: err}
+			}
+			if err := dst.Symlink(string(target), listing.path); err != nil {
+				return &EntryError{Path: listing.path, Op: "symlink", Err: err}
+			}
+			continue
+		}
+
+		file, err := dst.Create(listing.path)
+		if err != nil {
+			content.Close()
+			return &EntryError{Path: listing.path, Op: "create", Err: err}
+		}
+
+		unixMode := fs.FileMode(0o100644)
+		if listing.mode == ModeExecutable {
+			unixMode = 0o100755
+		}
+		if err := dst.Chmod(listing.path, unixMode); err != nil {
+			content.Close()
+			return &EntryError{Path: listing.path, Op: "chmod", Err: err}
+		}
+
+		if _, err := io.Copy(file, content); err != nil {
+			content.Close()
+			return &EntryError{Path: listing.path, Op: "write", Err: err}
+		}
+		content.Close()
+		if err := file.Close(); err != nil {
+			return &EntryError{Path: listing.path, Op: "close", Err: err}
+		}
+	}
+
+	return nil
+}
+
+// ArchiveChunked is the content-defined-chunking counterpart to Archive: it
+// archives inputDirectoryPath and buffers the finished archive in memory,
+// but with identical content deduplicated across entries rather than stored
+// once per file.
+func ArchiveChunked(inputDirectoryPath string, opts *Options) ([]byte, error) {
+	inputDirectoryPath, err := filepath.Abs(inputDirectoryPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make absolute path for path `%s`: %w", inputDirectoryPath, err)
+	}
+
+	var buf bytes.Buffer
+	cw, err := NewChunkedWriter(&buf, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := cw.WriteDirectory(inputDirectoryPath); err != nil {
+		return nil, err
+	}
+	if err := cw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// UnarchiveChunked is the content-defined-chunking counterpart to Unarchive:
+// it extracts a chunked archive already held in memory as a []byte into
+// outputDirectoryPath, verifying the whole-archive checksum first.
+func UnarchiveChunked(archive []byte, outputDirectoryPath string) error {
+	if len(archive) < 16 {
+		return fmt.Errorf("archive too small to contain a prefix: %w", ErrCorruptHeader)
+	}
+	if binary.LittleEndian.Uint64(archive[0:8]) != magicNumberChunked {
+		return fmt.Errorf("bad magic number: %w", ErrCorruptHeader)
+	}
+	if binary.LittleEndian.Uint64(archive[8:16]) != xxhash3.Hash(archive[16:]) {
+		return fmt.Errorf("whole-archive checksum: %w", ErrChecksumMismatch)
+	}
+
+	idx, err := OpenChunked(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		return err
+	}
+
+	return idx.ExtractAllFS(NewOSFS(outputDirectoryPath))
+}
@@ -0,0 +1,146 @@
+package decaf_reference
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/DataDog/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Codec compresses and decompresses the content of a single bundle. Every
+// Bundle records which Codec produced its compressed bytes (see Bundle.codec
+// and codecByID), so an archive can mix codecs freely: one bundle might be
+// zstd, the next none at all, depending on what Options.Codec or
+// Options.CodecSelector chose for it at write time.
+type Codec interface {
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+
+	// ID is the single byte recorded alongside a bundle to say which Codec
+	// can decompress it again. It must be stable across versions of this
+	// package; codecByID is the only place that interprets it.
+	ID() uint8
+}
+
+// Codec IDs recorded in a bundle header entry. Unrecognized values are
+// rejected with ErrUnsupportedVersion rather than guessed at, the same way
+// an unrecognized Listing mode is.
+const (
+	codecZstd uint8 = iota
+	codecLZ4
+	codecGzip
+	codecNone
+)
+
+// ZstdCodec compresses with zstd, the algorithm every DeCAF archive used
+// before bundles could pick a Codec individually. A zero Level selects the 3
+// Archive has always defaulted to.
+type ZstdCodec struct {
+	Level int
+}
+
+func (c ZstdCodec) ID() uint8 { return codecZstd }
+
+func (c ZstdCodec) Compress(data []byte) ([]byte, error) {
+	level := c.Level
+	if level == 0 {
+		level = 3
+	}
+	return zstd.CompressLevel(nil, data, level)
+}
+
+func (c ZstdCodec) Decompress(data []byte) ([]byte, error) {
+	return zstd.Decompress(nil, data)
+}
+
+// LZ4Codec compresses with lz4, trading compression ratio for speed relative
+// to ZstdCodec.
+type LZ4Codec struct{}
+
+func (c LZ4Codec) ID() uint8 { return codecLZ4 }
+
+func (c LZ4Codec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := lz4.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to lz4-compress bundle: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finish lz4-compressing bundle: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (c LZ4Codec) Decompress(data []byte) ([]byte, error) {
+	r := lz4.NewReader(bytes.NewReader(data))
+	decompressed, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lz4-decompress bundle: %w", err)
+	}
+	return decompressed, nil
+}
+
+// GzipCodec compresses with gzip at its default level, for interop with
+// tooling that already expects gzip over a bespoke codec.
+type GzipCodec struct{}
+
+func (c GzipCodec) ID() uint8 { return codecGzip }
+
+func (c GzipCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to gzip-compress bundle: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finish gzip-compressing bundle: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (c GzipCodec) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to gzip-decompress bundle: %w", err)
+	}
+	defer r.Close()
+	decompressed, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to gzip-decompress bundle: %w", err)
+	}
+	return decompressed, nil
+}
+
+// NoneCodec stores a bundle's content as-is. It exists for content that's
+// already compressed upstream (images, video, ...), where running it through
+// zstd or lz4 again burns CPU for little to no space savings; a
+// CodecSelector can pick NoneCodec for bundles it detects are already dense.
+type NoneCodec struct{}
+
+func (c NoneCodec) ID() uint8 { return codecNone }
+
+func (c NoneCodec) Compress(data []byte) ([]byte, error) { return data, nil }
+
+func (c NoneCodec) Decompress(data []byte) ([]byte, error) { return data, nil }
+
+// codecByID returns the Codec that can decompress a bundle recorded with the
+// given codec ID. An archive written by a future version of this package
+// with another built-in codec fails here with ErrUnsupportedVersion, instead
+// of this version mistaking its bytes for one of the codecs it does know.
+func codecByID(id uint8) (Codec, error) {
+	switch id {
+	case codecZstd:
+		return ZstdCodec{}, nil
+	case codecLZ4:
+		return LZ4Codec{}, nil
+	case codecGzip:
+		return GzipCodec{}, nil
+	case codecNone:
+		return NoneCodec{}, nil
+	default:
+		return nil, fmt.Errorf("bundle codec %d: %w", id, ErrUnsupportedVersion)
+	}
+}
@@ -0,0 +1,224 @@
+package decaf_reference
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/bytedance/gopkg/util/xxhash3"
+)
+
+// RepackOptions configures Repack.
+type RepackOptions struct {
+	// Filter is called once per listing in the source archive, with that
+	// listing's archive-relative path. It returns the path the listing
+	// should be written under in the destination archive, and whether to
+	// keep it at all; returning a different path than it was given renames
+	// the listing. A nil Filter keeps every listing under its original
+	// path, making Repack a plain copy.
+	Filter func(path string) (newPath string, keep bool)
+}
+
+// repackedEntry is one listing carried over into a repacked archive, still
+// pointing at the source Index whose bundle holds its content.
+type repackedEntry struct {
+	path    string
+	source  *Index
+	listing *Listing
+}
+
+// Repack copies listings from the archive at src into dst, applying
+// opts.Filter to decide which listings survive and what path each is
+// written under, without decompressing a single bundle more than it has to.
+// When every listing originally packed into a bundle survives the filter,
+// that bundle's compressed bytes are copied into dst as-is and only its
+// position in the new data section is recomputed; only when a bundle loses
+// at least one listing is it decompressed, so its survivors can be
+// repacked into a smaller bundle recompressed with the same Codec the
+// original bundle used.
+func Repack(src io.ReaderAt, srcSize int64, dst io.Writer, opts RepackOptions) error {
+	idx, err := Open(src, srcSize)
+	if err != nil {
+		return fmt.Errorf("failed to open source archive: %w", err)
+	}
+
+	filter := opts.Filter
+	if filter == nil {
+		filter = func(path string) (string, bool) { return path, true }
+	}
+
+	entries := make([]repackedEntry, 0, len(idx.listings))
+	for _, listing := range idx.listings {
+		newPath, keep := filter(listing.path)
+		if !keep {
+			continue
+		}
+		entries = append(entries, repackedEntry{path: newPath, source: idx, listing: listing})
+	}
+
+	return repackEntries(dst, entries)
+}
+
+// Merge concatenates the archives in archives into one, keeping every
+// listing's path unless it appears in more than one archive, in which case
+// the copy from the last archive to contain it wins -- the same
+// last-one-wins precedence a layered build system would want when later
+// archives represent layers applied on top of earlier ones. It's built
+// directly on the bundle-copying primitive behind Repack, so a bundle whose
+// listings all survive the merge is never decompressed.
+//
+// Merge takes whole archives as []byte, the same convenience Archive and
+// Unarchive already offer, rather than io.ReaderAt: unlike Open and Repack,
+// which stream from a source a caller already knows the size of, there's no
+// portable way to ask an arbitrary io.ReaderAt for its own length.
+func Merge(archives ...[]byte) ([]byte, error) {
+	indices := make([]*Index, len(archives))
+	for i, archive := range archives {
+		idx, err := Open(bytes.NewReader(archive), int64(len(archive)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open archive %d of %d to merge: %w", i+1, len(archives), err)
+		}
+		indices[i] = idx
+	}
+
+	order := make([]string, 0)
+	byPath := make(map[string]repackedEntry)
+	for _, idx := range indices {
+		for _, listing := range idx.listings {
+			if _, seen := byPath[listing.path]; !seen {
+				order = append(order, listing.path)
+			}
+			byPath[listing.path] = repackedEntry{path: listing.path, source: idx, listing: listing}
+		}
+	}
+
+	entries := make([]repackedEntry, len(order))
+	for i, path := range order {
+		entries[i] = byPath[path]
+	}
+
+	var buf bytes.Buffer
+	if err := repackEntries(&buf, entries); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// repackEntries groups entries by the source bundle each one's content
+// still lives in, copies or recompresses each group exactly once per
+// Repack's doc comment, and writes the result to dst via writeArchive. It's
+// the shared engine behind Repack and Merge.
+func repackEntries(dst io.Writer, entries []repackedEntry) error {
+	type bundleKey struct {
+		source      *Index
+		bundleIndex uint64
+	}
+
+	groupOrder := []bundleKey{}
+	groups := map[bundleKey][]repackedEntry{}
+	for _, entry := range entries {
+		key := bundleKey{source: entry.source, bundleIndex: entry.listing.bundleIndex}
+		if _, seen := groups[key]; !seen {
+			groupOrder = append(groupOrder, key)
+		}
+		groups[key] = append(groups[key], entry)
+	}
+
+	// sourceBundleListingCounts[source][bundleIndex] is how many listings
+	// that source's bundle originally held, so a group can tell whether
+	// every one of them survived into entries.
+	sourceBundleListingCounts := map[*Index]map[uint64]int{}
+	for _, entry := range entries {
+		counts, ok := sourceBundleListingCounts[entry.source]
+		if !ok {
+			counts = map[uint64]int{}
+			for _, listing := range entry.source.listings {
+				counts[listing.bundleIndex]++
+			}
+			sourceBundleListingCounts[entry.source] = counts
+		}
+	}
+
+	listings := make([]*Listing, 0, len(entries))
+	bundles := make([]*Bundle, 0, len(groupOrder))
+
+	for newBundleIndex, key := range groupOrder {
+		group := groups[key]
+		sourceBundle := key.source.bundles[key.bundleIndex]
+		fullyKept := len(group) == sourceBundleListingCounts[key.source][key.bundleIndex]
+
+		var bundle *Bundle
+		if fullyKept {
+			compressed := make([]byte, sourceBundle.compressedSize)
+			offset := key.source.dataSectionStart + int64(sourceBundle.offsetInDataSection)
+			if _, err := key.source.r.ReadAt(compressed, offset); err != nil {
+				return fmt.Errorf("failed to read bundle %d verbatim: %w", key.bundleIndex, err)
+			}
+			bundle = &Bundle{
+				uncompressedChecksum: sourceBundle.uncompressedChecksum,
+				compressedSize:       sourceBundle.compressedSize,
+				codec:                sourceBundle.codec,
+				data:                 compressed,
+			}
+			for _, entry := range group {
+				listings = append(listings, &Listing{
+					totalLength:  uint16(len(entry.path)) + 35,
+					bundleIndex:  uint64(newBundleIndex),
+					bundleOffset: entry.listing.bundleOffset,
+					contentSize:  entry.listing.contentSize,
+					checksum:     entry.listing.checksum,
+					mode:         entry.listing.mode,
+					path:         entry.path,
+				})
+			}
+		} else {
+			content, err := key.source.bundleContent(key.bundleIndex)
+			if err != nil {
+				return fmt.Errorf("failed to decompress bundle %d: %w", key.bundleIndex, err)
+			}
+
+			uncompressedData := []byte{}
+			currentOffset := uint64(0)
+			for _, entry := range group {
+				entryContent := content[entry.listing.bundleOffset : entry.listing.bundleOffset+entry.listing.contentSize]
+				uncompressedData = append(uncompressedData, entryContent...)
+
+				listings = append(listings, &Listing{
+					totalLength:  uint16(len(entry.path)) + 35,
+					bundleIndex:  uint64(newBundleIndex),
+					bundleOffset: currentOffset,
+					contentSize:  entry.listing.contentSize,
+					checksum:     entry.listing.checksum,
+					mode:         entry.listing.mode,
+					path:         entry.path,
+				})
+				currentOffset += entry.listing.contentSize
+			}
+
+			codec, err := codecByID(sourceBundle.codec)
+			if err != nil {
+				return fmt.Errorf("bundle %d: %w", key.bundleIndex, err)
+			}
+			compressedData, err := codec.Compress(uncompressedData)
+			if err != nil {
+				return fmt.Errorf("failed to recompress bundle %d: %w", key.bundleIndex, err)
+			}
+			bundle = &Bundle{
+				uncompressedChecksum: xxhash3.Hash(uncompressedData),
+				compressedSize:       uint64(len(compressedData)),
+				codec:                codec.ID(),
+				data:                 compressedData,
+			}
+		}
+
+		bundles = append(bundles, bundle)
+	}
+
+	currentOffsetInDataSection := uint64(0)
+	for _, bundle := range bundles {
+		bundle.offsetInDataSection = currentOffsetInDataSection
+		currentOffsetInDataSection += bundle.compressedSize
+	}
+
+	return writeArchive(dst, listings, bundles)
+}
@@ -1,13 +1,18 @@
 package decaf_reference
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"slices"
 	"strings"
 	"testing"
+	"testing/fstest"
 )
 
 func TestEndToEnd(t *testing.T) {
@@ -118,6 +123,850 @@ func TestUnarchivingAllCases(t *testing.T) {
 	}
 }
 
+func TestArchiveFSUnarchiveFS(t *testing.T) {
+	srcFS := fstest.MapFS{
+		"hello.txt": {Data: []byte("hello world"), Mode: 0o644},
+		"run.sh":    {Data: []byte("#!/bin/sh\necho hi\n"), Mode: 0o755},
+	}
+
+	archive, err := ArchiveFS(srcFS, ".", nil)
+	if err != nil {
+		t.Errorf("archiving failed: %s", err)
+		t.FailNow()
+	}
+
+	tempDir, err := os.MkdirTemp("", "decaf-TestArchiveFSUnarchiveFS-*")
+	if err != nil {
+		t.Errorf("setting up temporary directory failed: %s", err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+
+	if err := UnarchiveFS(NewOSFS(tempDir), archive); err != nil {
+		t.Errorf("unarchiving failed: %s", err)
+		t.FailNow()
+	}
+
+	got, err := os.ReadFile(filepath.Join(tempDir, "hello.txt"))
+	if err != nil {
+		t.Errorf("reading extracted `hello.txt` failed: %s", err)
+		t.FailNow()
+	}
+	if string(got) != "hello world" {
+		t.Errorf("got `%s`, want `hello world`", got)
+	}
+}
+
+func TestArchiveFSUnarchiveFSNestedDirectory(t *testing.T) {
+	srcFS := fstest.MapFS{
+		"sub/hello.txt": {Data: []byte("hello world"), Mode: 0o644},
+	}
+
+	archive, err := ArchiveFS(srcFS, ".", nil)
+	if err != nil {
+		t.Errorf("archiving failed: %s", err)
+		t.FailNow()
+	}
+
+	tempDir, err := os.MkdirTemp("", "decaf-TestArchiveFSUnarchiveFSNestedDirectory-*")
+	if err != nil {
+		t.Errorf("setting up temporary directory failed: %s", err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+
+	if err := UnarchiveFS(NewOSFS(tempDir), archive); err != nil {
+		t.Errorf("unarchiving failed: %s", err)
+		t.FailNow()
+	}
+
+	got, err := os.ReadFile(filepath.Join(tempDir, "sub", "hello.txt"))
+	if err != nil {
+		t.Errorf("reading extracted `sub/hello.txt` failed: %s", err)
+		t.FailNow()
+	}
+	if string(got) != "hello world" {
+		t.Errorf("got `%s`, want `hello world`", got)
+	}
+}
+
+func TestArchiveWithOptionsFiltering(t *testing.T) {
+	srcFS := fstest.MapFS{
+		"hello.txt": {Data: []byte("hello world"), Mode: 0o644},
+		"main.go":   {Data: []byte("package main\n"), Mode: 0o644},
+		"README.md": {Data: []byte("# decaf\n"), Mode: 0o644},
+	}
+
+	archive, err := ArchiveFS(srcFS, ".", &Options{Include: []string{"**/*.go", "**/*.txt"}, Exclude: []string{"hello.txt"}})
+	if err != nil {
+		t.Errorf("archiving failed: %s", err)
+		t.FailNow()
+	}
+
+	entries, err := ListEntries(archive)
+	if err != nil {
+		t.Errorf("listing entries failed: %s", err)
+		t.FailNow()
+	}
+	if len(entries) != 1 || entries[0].Path != "main.go" {
+		t.Errorf("got entries %+v, want only `main.go`", entries)
+	}
+}
+
+func TestUnarchiveWithOptionsFiltering(t *testing.T) {
+	srcFS := fstest.MapFS{
+		"hello.txt": {Data: []byte("hello world"), Mode: 0o644},
+		"main.go":   {Data: []byte("package main\n"), Mode: 0o644},
+	}
+
+	archive, err := ArchiveFS(srcFS, ".", nil)
+	if err != nil {
+		t.Errorf("archiving failed: %s", err)
+		t.FailNow()
+	}
+
+	tempDir, err := os.MkdirTemp("", "decaf-TestUnarchiveWithOptionsFiltering-*")
+	if err != nil {
+		t.Errorf("setting up temporary directory failed: %s", err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+
+	opts := UnarchiveOptions{Include: []string{"**/*.go"}}
+	if err := UnarchiveWithOptions(archive, tempDir, opts); err != nil {
+		t.Errorf("unarchiving failed: %s", err)
+		t.FailNow()
+	}
+
+	if _, err := os.Stat(filepath.Join(tempDir, "main.go")); err != nil {
+		t.Errorf("expected `main.go` to be extracted: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, "hello.txt")); !os.IsNotExist(err) {
+		t.Errorf("expected `hello.txt` to be skipped, got err = %v", err)
+	}
+}
+
+func TestArchiveDeterministicAcrossConcurrency(t *testing.T) {
+	srcFS := fstest.MapFS{
+		"a.txt": {Data: []byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"), Mode: 0o644},
+		"b.txt": {Data: []byte("bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"), Mode: 0o644},
+		"c.sh":  {Data: []byte("#!/bin/sh\necho c\n"), Mode: 0o755},
+	}
+
+	want, err := ArchiveFS(srcFS, ".", &Options{Concurrency: 1})
+	if err != nil {
+		t.Errorf("archiving with concurrency 1 failed: %s", err)
+		t.FailNow()
+	}
+
+	for _, workers := range []int{0, 2, 4, 8} {
+		got, err := ArchiveFS(srcFS, ".", &Options{Concurrency: workers})
+		if err != nil {
+			t.Errorf("archiving with concurrency %d failed: %s", workers, err)
+			t.FailNow()
+		}
+		if !bytes.Equal(want, got) {
+			t.Errorf("archive with concurrency %d differs byte-for-byte from concurrency 1", workers)
+		}
+	}
+}
+
+func TestPerBundleCodecSelector(t *testing.T) {
+	srcFS := fstest.MapFS{
+		"hello.txt": {Data: []byte("hello world"), Mode: 0o644},
+		"main.go":   {Data: []byte("package main\n"), Mode: 0o644},
+	}
+
+	for _, codec := range []Codec{ZstdCodec{}, LZ4Codec{}, GzipCodec{}, NoneCodec{}} {
+		archive, err := ArchiveFS(srcFS, ".", &Options{Codec: codec})
+		if err != nil {
+			t.Errorf("archiving with codec %d failed: %s", codec.ID(), err)
+			continue
+		}
+
+		index, err := Open(bytes.NewReader(archive), int64(len(archive)))
+		if err != nil {
+			t.Errorf("opening archive compressed with codec %d failed: %s", codec.ID(), err)
+			continue
+		}
+		for _, bundle := range index.bundles {
+			if bundle.codec != codec.ID() {
+				t.Errorf("bundle written with codec %d was recorded as codec %d", codec.ID(), bundle.codec)
+			}
+		}
+
+		got, err := index.Extract("hello.txt")
+		if err != nil {
+			t.Errorf("extracting `hello.txt` compressed with codec %d failed: %s", codec.ID(), err)
+			continue
+		}
+		if string(got) != "hello world" {
+			t.Errorf("codec %d: got %q, want %q", codec.ID(), got, "hello world")
+		}
+	}
+}
+
+func TestArchiveCodecSelectorPicksPerBundle(t *testing.T) {
+	// Two large files, each its own bundle, so CodecSelector can tell them
+	// apart by the listings packed into each bundle and pick a different
+	// Codec for each.
+	srcFS := fstest.MapFS{
+		"already-compressed.bin": {Data: bytes.Repeat([]byte{0xDE, 0xAD, 0xBE, 0xEF}, 3*1024*1024), Mode: 0o644},
+		"plain.txt":              {Data: bytes.Repeat([]byte("go gophers go "), 1024*1024), Mode: 0o644},
+	}
+
+	selector := func(listings []*Listing) Codec {
+		for _, listing := range listings {
+			if strings.HasSuffix(listing.path, ".bin") {
+				return NoneCodec{}
+			}
+		}
+		return ZstdCodec{}
+	}
+
+	archive, err := ArchiveFS(srcFS, ".", &Options{CodecSelector: selector})
+	if err != nil {
+		t.Errorf("archiving with a CodecSelector failed: %s", err)
+		t.FailNow()
+	}
+
+	index, err := Open(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Errorf("opening archive failed: %s", err)
+		t.FailNow()
+	}
+
+	sawNone, sawZstd := false, false
+	for _, bundle := range index.bundles {
+		switch bundle.codec {
+		case codecNone:
+			sawNone = true
+		case codecZstd:
+			sawZstd = true
+		}
+	}
+	if !sawNone || !sawZstd {
+		t.Errorf("expected both a NoneCodec and a ZstdCodec bundle, got sawNone=%v sawZstd=%v", sawNone, sawZstd)
+	}
+
+	for _, path := range []string{"already-compressed.bin", "plain.txt"} {
+		got, err := index.Extract(path)
+		if err != nil {
+			t.Errorf("extracting `%s` failed: %s", path, err)
+			continue
+		}
+		want, _ := fs.ReadFile(srcFS, path)
+		if !bytes.Equal(got, want) {
+			t.Errorf("`%s`: extracted content didn't match source", path)
+		}
+	}
+}
+
+func TestOpenRejectsUnsupportedFormatVersion(t *testing.T) {
+	srcFS := fstest.MapFS{
+		"hello.txt": {Data: []byte("hello world"), Mode: 0o644},
+	}
+
+	archive, err := ArchiveFS(srcFS, ".", nil)
+	if err != nil {
+		t.Errorf("archiving failed: %s", err)
+		t.FailNow()
+	}
+
+	// The meta header's formatVersion is the 8 bytes right after the 16-byte
+	// prefix and the listingHeaderSize/listingCount/bundleCount fields.
+	const formatVersionOffset = 16 + 24
+	corrupted := bytes.Clone(archive)
+	corrupted[formatVersionOffset] = 0xFF
+
+	if _, err := Open(bytes.NewReader(corrupted), int64(len(corrupted))); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("got err = %v, want ErrUnsupportedVersion", err)
+	}
+
+	if _, err := NewReader(bytes.NewReader(corrupted)); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("got err = %v, want ErrUnsupportedVersion", err)
+	}
+}
+
+func TestArchiveToUnarchiveFrom(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "decaf-TestArchiveToUnarchiveFrom-*")
+	if err != nil {
+		t.Errorf("setting up temporary directory failed: %s", err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+
+	srcDir := filepath.Join(tempDir, "src")
+	if err := os.Mkdir(srcDir, 0o755); err != nil {
+		t.Errorf("setting up source directory failed: %s", err)
+		t.FailNow()
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "hello.txt"), []byte("hello world"), 0o644); err != nil {
+		t.Errorf("writing source file failed: %s", err)
+		t.FailNow()
+	}
+
+	archivePath := filepath.Join(tempDir, "archive.df")
+	archiveFile, err := os.Create(archivePath)
+	if err != nil {
+		t.Errorf("creating archive file failed: %s", err)
+		t.FailNow()
+	}
+	if err := ArchiveTo(srcDir, archiveFile); err != nil {
+		t.Errorf("ArchiveTo failed: %s", err)
+		t.FailNow()
+	}
+	if err := archiveFile.Close(); err != nil {
+		t.Errorf("closing archive file failed: %s", err)
+		t.FailNow()
+	}
+
+	archiveFile, err = os.Open(archivePath)
+	if err != nil {
+		t.Errorf("reopening archive file failed: %s", err)
+		t.FailNow()
+	}
+	defer archiveFile.Close()
+	stat, err := archiveFile.Stat()
+	if err != nil {
+		t.Errorf("stat of archive file failed: %s", err)
+		t.FailNow()
+	}
+
+	outDir := filepath.Join(tempDir, "out")
+	if err := UnarchiveFrom(archiveFile, stat.Size(), outDir); err != nil {
+		t.Errorf("UnarchiveFrom failed: %s", err)
+		t.FailNow()
+	}
+
+	got, err := os.ReadFile(filepath.Join(outDir, "hello.txt"))
+	if err != nil {
+		t.Errorf("reading extracted `hello.txt` failed: %s", err)
+		t.FailNow()
+	}
+	if string(got) != "hello world" {
+		t.Errorf("got `%s`, want `hello world`", got)
+	}
+}
+
+func TestChunkedArchiveDeduplicatesAndRoundTrips(t *testing.T) {
+	// Random rather than repetitive content, and well larger than a single
+	// average chunk (~1 MiB), so the gear hash actually finds a handful of
+	// natural chunk boundaries inside it instead of only ever cutting at the
+	// forced end-of-data boundary.
+	shared := make([]byte, 6*1024*1024)
+	rand.New(rand.NewSource(42)).Read(shared)
+
+	srcFS := fstest.MapFS{
+		"one.bin":  {Data: shared, Mode: 0o644},
+		"two.bin":  {Data: append(append([]byte{}, shared...), []byte("...with a small unique tail")...), Mode: 0o644},
+		"three.go": {Data: []byte("package main\n"), Mode: 0o644},
+	}
+
+	var buf bytes.Buffer
+	cw, err := NewChunkedWriter(&buf, nil)
+	if err != nil {
+		t.Errorf("NewChunkedWriter failed: %s", err)
+		t.FailNow()
+	}
+	if err := cw.WriteFS(srcFS, "."); err != nil {
+		t.Errorf("WriteFS failed: %s", err)
+		t.FailNow()
+	}
+	if err := cw.Close(); err != nil {
+		t.Errorf("Close failed: %s", err)
+		t.FailNow()
+	}
+	archive := buf.Bytes()
+
+	idx, err := OpenChunked(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Errorf("OpenChunked failed: %s", err)
+		t.FailNow()
+	}
+
+	// The chunk table must not be empty; whether one.bin and two.bin, which
+	// share a long common prefix, actually share chunk indices is checked
+	// further down, after both round-trip.
+	if len(idx.chunks) == 0 {
+		t.Errorf("expected at least one chunk in the chunk table")
+	}
+
+	oneContent, err := idx.Open("one.bin")
+	if err != nil {
+		t.Errorf("opening `one.bin` failed: %s", err)
+		t.FailNow()
+	}
+	oneGot, err := io.ReadAll(oneContent)
+	oneContent.Close()
+	if err != nil || !bytes.Equal(oneGot, shared) {
+		t.Errorf("one.bin round-tripped incorrectly")
+	}
+
+	twoContent, err := idx.Open("two.bin")
+	if err != nil {
+		t.Errorf("opening `two.bin` failed: %s", err)
+		t.FailNow()
+	}
+	twoGot, err := io.ReadAll(twoContent)
+	twoContent.Close()
+	if err != nil || !bytes.Equal(twoGot, srcFS["two.bin"].Data) {
+		t.Errorf("two.bin round-tripped incorrectly")
+	}
+
+	oneListing := idx.byPath["one.bin"]
+	twoListing := idx.byPath["two.bin"]
+	sharedChunkIndices := map[uint64]bool{}
+	for _, c := range oneListing.chunks {
+		sharedChunkIndices[c.chunkIndex] = true
+	}
+	foundSharedChunk := false
+	for _, c := range twoListing.chunks {
+		if sharedChunkIndices[c.chunkIndex] {
+			foundSharedChunk = true
+			break
+		}
+	}
+	if !foundSharedChunk {
+		t.Errorf("expected one.bin and two.bin to share at least one chunk index")
+	}
+
+	tempDir, err := os.MkdirTemp("", "decaf-TestChunkedArchiveDeduplicatesAndRoundTrips-*")
+	if err != nil {
+		t.Errorf("setting up temporary directory failed: %s", err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+
+	if err := UnarchiveChunked(archive, tempDir); err != nil {
+		t.Errorf("UnarchiveChunked failed: %s", err)
+		t.FailNow()
+	}
+
+	threeGot, err := os.ReadFile(filepath.Join(tempDir, "three.go"))
+	if err != nil || string(threeGot) != "package main\n" {
+		t.Errorf("three.go did not round-trip through UnarchiveChunked correctly")
+	}
+}
+
+func TestOpenSingleFileExtraction(t *testing.T) {
+	srcFS := fstest.MapFS{
+		"hello.txt": {Data: []byte("hello world"), Mode: 0o644},
+		"main.go":   {Data: []byte("package main\n"), Mode: 0o644},
+	}
+
+	archive, err := ArchiveFS(srcFS, ".", nil)
+	if err != nil {
+		t.Errorf("archiving failed: %s", err)
+		t.FailNow()
+	}
+
+	index, err := Open(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Errorf("opening archive failed: %s", err)
+		t.FailNow()
+	}
+
+	entries := index.Entries()
+	if len(entries) != 2 {
+		t.Errorf("got %d entries, want 2", len(entries))
+	}
+
+	entry, err := index.Entry("main.go")
+	if err != nil {
+		t.Errorf("looking up entry failed: %s", err)
+		t.FailNow()
+	}
+
+	content, err := entry.Open()
+	if err != nil {
+		t.Errorf("opening entry failed: %s", err)
+		t.FailNow()
+	}
+	defer content.Close()
+
+	got, err := io.ReadAll(content)
+	if err != nil {
+		t.Errorf("reading entry content failed: %s", err)
+		t.FailNow()
+	}
+	if string(got) != "package main\n" {
+		t.Errorf("got `%s`, want `package main\\n`", got)
+	}
+
+	_, err = index.Entry("does-not-exist.go")
+	if err == nil {
+		t.Errorf("expected an error looking up a nonexistent entry")
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected errors.Is(err, fs.ErrNotExist), got %v", err)
+	}
+	var entryErr *EntryError
+	if !errors.As(err, &entryErr) || entryErr.Path != "does-not-exist.go" {
+		t.Errorf("expected an *EntryError for `does-not-exist.go`, got %v", err)
+	}
+}
+
+func TestIndexFilesExtractOpenFile(t *testing.T) {
+	srcFS := fstest.MapFS{
+		"hello.txt": {Data: []byte("hello world"), Mode: 0o644},
+		"main.go":   {Data: []byte("package main\n"), Mode: 0o644},
+	}
+
+	archive, err := ArchiveFS(srcFS, ".", nil)
+	if err != nil {
+		t.Errorf("archiving failed: %s", err)
+		t.FailNow()
+	}
+
+	index, err := Open(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Errorf("opening archive failed: %s", err)
+		t.FailNow()
+	}
+	index.SetCacheSize(1)
+
+	if len(index.Files()) != 2 {
+		t.Errorf("got %d files, want 2", len(index.Files()))
+	}
+
+	got, err := index.Extract("hello.txt")
+	if err != nil {
+		t.Errorf("Extract failed: %s", err)
+		t.FailNow()
+	}
+	if string(got) != "hello world" {
+		t.Errorf("got `%s`, want `hello world`", got)
+	}
+
+	// Extract again so the second call is served from the bundle cache
+	// rather than decompressing again.
+	got, err = index.Extract("hello.txt")
+	if err != nil {
+		t.Errorf("second Extract failed: %s", err)
+		t.FailNow()
+	}
+	if string(got) != "hello world" {
+		t.Errorf("got `%s`, want `hello world`", got)
+	}
+
+	r, err := index.OpenFile("main.go")
+	if err != nil {
+		t.Errorf("OpenFile failed: %s", err)
+		t.FailNow()
+	}
+	defer r.Close()
+	mainGot, err := io.ReadAll(r)
+	if err != nil || string(mainGot) != "package main\n" {
+		t.Errorf("OpenFile round-tripped `main.go` incorrectly")
+	}
+}
+
+func TestRepackCopiesFullyKeptBundlesVerbatim(t *testing.T) {
+	srcFS := fstest.MapFS{
+		"a.txt": {Data: []byte("aaaaaa"), Mode: 0o644},
+		"b.txt": {Data: []byte("bbbbbb"), Mode: 0o644},
+		"c.txt": {Data: []byte("cccccc"), Mode: 0o644},
+	}
+
+	archive, err := ArchiveFS(srcFS, ".", nil)
+	if err != nil {
+		t.Errorf("archiving failed: %s", err)
+		t.FailNow()
+	}
+
+	srcIdx, err := Open(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Errorf("opening source archive failed: %s", err)
+		t.FailNow()
+	}
+
+	// Find the bundle that holds two of the three listings, and the path of
+	// the listing left alone in another bundle -- that lone listing is the
+	// one we'll drop, so its whole bundle disappears while the shared
+	// bundle survives intact and can be copied verbatim.
+	byBundle := map[uint64][]string{}
+	for _, listing := range srcIdx.listings {
+		byBundle[listing.bundleIndex] = append(byBundle[listing.bundleIndex], listing.path)
+	}
+	var keptBundle uint64
+	var dropPath string
+	for bundleIndex, paths := range byBundle {
+		if len(paths) == 2 {
+			keptBundle = bundleIndex
+		} else if len(paths) == 1 {
+			dropPath = paths[0]
+		}
+	}
+	if dropPath == "" {
+		t.Fatalf("test assumes one listing ends up alone in its own bundle, got %v", byBundle)
+	}
+
+	var buf bytes.Buffer
+	opts := RepackOptions{Filter: func(path string) (string, bool) {
+		return path, path != dropPath
+	}}
+	if err := Repack(bytes.NewReader(archive), int64(len(archive)), &buf, opts); err != nil {
+		t.Errorf("Repack failed: %s", err)
+		t.FailNow()
+	}
+	repacked := buf.Bytes()
+
+	dstIdx, err := Open(bytes.NewReader(repacked), int64(len(repacked)))
+	if err != nil {
+		t.Errorf("opening repacked archive failed: %s", err)
+		t.FailNow()
+	}
+	if len(dstIdx.Entries()) != 2 {
+		t.Errorf("got %d entries, want 2", len(dstIdx.Entries()))
+	}
+	if _, err := dstIdx.Entry(dropPath); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected `%s` to be gone, got err = %v", dropPath, err)
+	}
+
+	keptPaths := byBundle[keptBundle]
+
+	// The whole bundle the two surviving listings shared was kept intact,
+	// so its compressed bytes should have been copied verbatim rather than
+	// recompressed.
+	srcBundle := srcIdx.bundles[keptBundle]
+	dstBundle := dstIdx.bundles[dstIdx.byPath[keptPaths[0]].bundleIndex]
+	srcCompressed := make([]byte, srcBundle.compressedSize)
+	if _, err := srcIdx.r.ReadAt(srcCompressed, srcIdx.dataSectionStart+int64(srcBundle.offsetInDataSection)); err != nil {
+		t.Errorf("reading source bundle failed: %s", err)
+	}
+	dstCompressed := make([]byte, dstBundle.compressedSize)
+	if _, err := dstIdx.r.ReadAt(dstCompressed, dstIdx.dataSectionStart+int64(dstBundle.offsetInDataSection)); err != nil {
+		t.Errorf("reading repacked bundle failed: %s", err)
+	}
+	if !bytes.Equal(srcCompressed, dstCompressed) {
+		t.Errorf("expected the fully-kept bundle's compressed bytes to be copied verbatim")
+	}
+
+	for _, path := range keptPaths {
+		got, err := dstIdx.Extract(path)
+		if err != nil {
+			t.Errorf("extracting `%s` failed: %s", path, err)
+			continue
+		}
+		want, _ := fs.ReadFile(srcFS, path)
+		if !bytes.Equal(got, want) {
+			t.Errorf("`%s`: got %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestRepackRecompressesPartiallyKeptBundles(t *testing.T) {
+	srcFS := fstest.MapFS{
+		"a.txt": {Data: []byte("aaaaaa"), Mode: 0o644},
+		"b.txt": {Data: []byte("bbbbbb"), Mode: 0o644},
+		"c.txt": {Data: []byte("cccccc"), Mode: 0o644},
+	}
+
+	archive, err := ArchiveFS(srcFS, ".", nil)
+	if err != nil {
+		t.Errorf("archiving failed: %s", err)
+		t.FailNow()
+	}
+
+	srcIdx, err := Open(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Errorf("opening source archive failed: %s", err)
+		t.FailNow()
+	}
+
+	// Find the two listings sharing a bundle and drop just one of them, so
+	// the bundle has to be decompressed and its survivor repacked rather
+	// than copied whole.
+	byBundle := map[uint64][]string{}
+	for _, listing := range srcIdx.listings {
+		byBundle[listing.bundleIndex] = append(byBundle[listing.bundleIndex], listing.path)
+	}
+	var sharedPaths []string
+	for _, paths := range byBundle {
+		if len(paths) == 2 {
+			sharedPaths = paths
+		}
+	}
+	if sharedPaths == nil {
+		t.Fatalf("test assumes two listings share a bundle, got %v", byBundle)
+	}
+	keepPath, dropPath := sharedPaths[0], sharedPaths[1]
+
+	var buf bytes.Buffer
+	opts := RepackOptions{Filter: func(path string) (string, bool) {
+		return "renamed/" + path, path != dropPath
+	}}
+	if err := Repack(bytes.NewReader(archive), int64(len(archive)), &buf, opts); err != nil {
+		t.Errorf("Repack failed: %s", err)
+		t.FailNow()
+	}
+	repacked := buf.Bytes()
+
+	dstIdx, err := Open(bytes.NewReader(repacked), int64(len(repacked)))
+	if err != nil {
+		t.Errorf("opening repacked archive failed: %s", err)
+		t.FailNow()
+	}
+	if len(dstIdx.Entries()) != 2 {
+		t.Errorf("got %d entries, want 2", len(dstIdx.Entries()))
+	}
+	if _, err := dstIdx.Entry("renamed/" + dropPath); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected `%s` to be gone, got err = %v", dropPath, err)
+	}
+
+	got, err := dstIdx.Extract("renamed/" + keepPath)
+	if err != nil {
+		t.Errorf("extracting renamed `%s` failed: %s", keepPath, err)
+		t.FailNow()
+	}
+	want, _ := fs.ReadFile(srcFS, keepPath)
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestMergeConcatenatesArchivesLastWriteWins(t *testing.T) {
+	base, err := ArchiveFS(fstest.MapFS{
+		"a.txt": {Data: []byte("from base"), Mode: 0o644},
+		"b.txt": {Data: []byte("base b"), Mode: 0o644},
+	}, ".", nil)
+	if err != nil {
+		t.Errorf("archiving base layer failed: %s", err)
+		t.FailNow()
+	}
+
+	overlay, err := ArchiveFS(fstest.MapFS{
+		"a.txt": {Data: []byte("from overlay"), Mode: 0o644},
+		"c.txt": {Data: []byte("overlay c"), Mode: 0o644},
+	}, ".", nil)
+	if err != nil {
+		t.Errorf("archiving overlay layer failed: %s", err)
+		t.FailNow()
+	}
+
+	merged, err := Merge(base, overlay)
+	if err != nil {
+		t.Errorf("Merge failed: %s", err)
+		t.FailNow()
+	}
+
+	idx, err := Open(bytes.NewReader(merged), int64(len(merged)))
+	if err != nil {
+		t.Errorf("opening merged archive failed: %s", err)
+		t.FailNow()
+	}
+	if len(idx.Entries()) != 3 {
+		t.Errorf("got %d entries, want 3", len(idx.Entries()))
+	}
+
+	want := map[string]string{"a.txt": "from overlay", "b.txt": "base b", "c.txt": "overlay c"}
+	for path, expected := range want {
+		got, err := idx.Extract(path)
+		if err != nil {
+			t.Errorf("extracting `%s` failed: %s", path, err)
+			continue
+		}
+		if string(got) != expected {
+			t.Errorf("`%s`: got %q, want %q", path, got, expected)
+		}
+	}
+}
+
+func TestUnarchiveDetectsChecksumMismatch(t *testing.T) {
+	srcFS := fstest.MapFS{
+		"hello.txt": {Data: []byte("hello world"), Mode: 0o644},
+	}
+
+	archive, err := ArchiveFS(srcFS, ".", nil)
+	if err != nil {
+		t.Errorf("archiving failed: %s", err)
+		t.FailNow()
+	}
+
+	// Flip every bit of the last byte, well past the headers, inside the compressed data section,
+	// without touching the whole-archive checksum in the prefix.
+	archive[len(archive)-1] ^= 0xFF
+
+	tempDir, err := os.MkdirTemp("", "decaf-TestUnarchiveDetectsChecksumMismatch-*")
+	if err != nil {
+		t.Errorf("setting up temporary directory failed: %s", err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+
+	err = Unarchive(archive, tempDir)
+	if err == nil {
+		t.Errorf("expected unarchiving a tampered archive to fail")
+		t.FailNow()
+	}
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expected errors.Is(err, ErrChecksumMismatch), got %v", err)
+	}
+}
+
+// maliciousEscapingArchive archives a single file, then repacks it with a
+// Filter that renames it to a "../"-escaping path, the same shape an
+// attacker-crafted or corrupted listing would take.
+func maliciousEscapingArchive(t *testing.T) []byte {
+	t.Helper()
+
+	srcFS := fstest.MapFS{
+		"hello.txt": {Data: []byte("hello world"), Mode: 0o644},
+	}
+	archive, err := ArchiveFS(srcFS, ".", nil)
+	if err != nil {
+		t.Fatalf("archiving failed: %s", err)
+	}
+
+	var buf bytes.Buffer
+	opts := RepackOptions{Filter: func(path string) (string, bool) {
+		return "../../../../tmp/decaf-poc/PWNED.txt", true
+	}}
+	if err := Repack(bytes.NewReader(archive), int64(len(archive)), &buf, opts); err != nil {
+		t.Fatalf("repacking failed: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func TestUnarchiveRejectsPathEscape(t *testing.T) {
+	archive := maliciousEscapingArchive(t)
+
+	tempDir, err := os.MkdirTemp("", "decaf-TestUnarchiveRejectsPathEscape-*")
+	if err != nil {
+		t.Errorf("setting up temporary directory failed: %s", err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+
+	err = Unarchive(archive, tempDir)
+	if !errors.Is(err, ErrPathEscape) {
+		t.Errorf("expected errors.Is(err, ErrPathEscape), got %v", err)
+	}
+}
+
+func TestExtractAllFSRejectsPathEscape(t *testing.T) {
+	archive := maliciousEscapingArchive(t)
+
+	idx, err := Open(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Errorf("opening archive failed: %s", err)
+		t.FailNow()
+	}
+
+	tempDir, err := os.MkdirTemp("", "decaf-TestExtractAllFSRejectsPathEscape-*")
+	if err != nil {
+		t.Errorf("setting up temporary directory failed: %s", err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+
+	err = idx.ExtractAllFS(NewOSFS(tempDir), 1)
+	if !errors.Is(err, ErrPathEscape) {
+		t.Errorf("expected errors.Is(err, ErrPathEscape), got %v", err)
+	}
+}
+
 type diffInfo struct {
 	path        string
 	permissions uint32
@@ -181,6 +1030,19 @@ func BenchmarkArchiving(b *testing.B) {
 	b.StopTimer()
 }
 
+func BenchmarkArchivingConcurrency(b *testing.B) {
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			_, err := ArchiveWithOptions("./testdata/toybox-0.8.11/", &Options{Concurrency: workers})
+			if err != nil {
+				b.Errorf("encountered an error while archiving toybox corpus: %s", err)
+				b.FailNow()
+			}
+			b.StopTimer()
+		})
+	}
+}
+
 func BenchmarkUnarchiving(b *testing.B) {
 	tempDir, err := os.MkdirTemp("", "decaf-BenchmarkUnarchiving-*")
 	if err != nil {